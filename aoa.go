@@ -320,7 +320,7 @@ const (
     AoaManufacturer = "Nick Lee of Hong Kong"
     AoaModel = "Plug n Pi Server"
     AoaDescription = "The Raspberry side of Plug n Pi"
-    AoaProtocolVersion = "2"
+    AoaProtocolVersion = "3"
     AoaUri = "https://github.com/nickoala/pnpi"
     AoaSerialNumber = "0123456789"
 )
@@ -0,0 +1,352 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// Same choice as raspi-config's CONFIG
+func bootConfigPath() string {
+    if _, err := os.Stat("/boot/firmware/config.txt"); err == nil {
+        return "/boot/firmware/config.txt"
+    }
+    return "/boot/config.txt"
+}
+
+// Taken before the first change, under /run like the reboot marker, so it
+// only covers changes not yet in effect.
+const bootConfigBackupPath = "/run/pnpi/config.txt"
+
+type configValidator func(string) error
+
+func intRange(min, max int) configValidator {
+    return func(v string) error {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < min || n > max {
+            return fmt.Errorf("Must be an integer from %v to %v", min, max)
+        }
+        return nil
+    }
+}
+
+func oneOf(choices ...string) configValidator {
+    return func(v string) error {
+        if !containString(choices, v) {
+            return fmt.Errorf("Must be one of %v", strings.Join(choices, ", "))
+        }
+        return nil
+    }
+}
+
+// An overlay or parameter name, optionally followed by ,param=value pairs
+var dtPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+(=[A-Za-z0-9_.:-]+)?(,[A-Za-z0-9_.-]+(=[A-Za-z0-9_.:-]+)?)*$`)
+
+func dtValue(v string) error {
+    if !dtPattern.MatchString(v) {
+        return fmt.Errorf("Not an overlay or parameter: %v", v)
+    }
+    return nil
+}
+
+var boolValue = intRange(0, 1)
+
+var rotation = oneOf("0", "1", "2", "3", "0x10000", "0x20000")
+
+// Keys the client may set. dtoverlay and dtparam may appear several times.
+var bootConfigKeys = map[string]configValidator{
+    "dtoverlay": dtValue,
+    "dtparam": dtValue,
+    "hdmi_force_hotplug": boolValue,
+    "hdmi_ignore_edid": oneOf("0xa5000080"),
+    "hdmi_drive": intRange(1, 2),
+    "hdmi_group": intRange(0, 2),
+    "hdmi_mode": intRange(1, 107),
+    "hdmi_boost": intRange(0, 11),
+    "config_hdmi_boost": intRange(0, 11),
+    "hdmi_blanking": intRange(0, 2),
+    "disable_overscan": boolValue,
+    "overscan_left": intRange(-256, 256),
+    "overscan_right": intRange(-256, 256),
+    "overscan_top": intRange(-256, 256),
+    "overscan_bottom": intRange(-256, 256),
+    "framebuffer_width": intRange(1, 7680),
+    "framebuffer_height": intRange(1, 4320),
+    "max_framebuffers": intRange(1, 3),
+    "display_rotate": rotation,
+    "display_hdmi_rotate": rotation,
+    "display_lcd_rotate": rotation,
+    "lcd_rotate": intRange(0, 3),
+    "display_auto_detect": boolValue,
+    "camera_auto_detect": boolValue,
+    "disable_splash": boolValue,
+    "avoid_warnings": intRange(0, 2),
+    "gpu_mem": intRange(16, 944),
+    "gpu_mem_256": intRange(16, 192),
+    "gpu_mem_512": intRange(16, 448),
+    "gpu_mem_1024": intRange(16, 944),
+    "start_x": boolValue,
+    "disable_camera_led": boolValue,
+    "enable_uart": boolValue,
+    "arm_64bit": boolValue,
+    "arm_freq": intRange(100, 3000),
+    "core_freq": intRange(100, 1000),
+    "over_voltage": intRange(-16, 8),
+    "force_turbo": boolValue,
+    "temp_limit": intRange(40, 85),
+}
+
+func isMultiKey(key string) bool {
+    return key == "dtoverlay" || key == "dtparam"
+}
+
+// Conditional filters, e.g. [pi4], [all], [HDMI:1], [EDID=...], [gpio4=1]
+var sectionPattern = regexp.MustCompile(`^[A-Za-z0-9:+=_.-]+$`)
+
+type configLine struct {
+    text string
+    section string   // "" before any section header
+    key, value string
+}
+
+func (n *configLine) isEntry() bool {
+    return n.key != ""
+}
+
+func parseBootConfig(text string) []configLine {
+    var lines []configLine
+    section := ""
+    for _,t := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+        s := strings.TrimSpace(t)
+        n := configLine{text: t}
+
+        if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+            section = s[1:len(s)-1]
+        } else if s != "" && !strings.HasPrefix(s, "#") {
+            if i := strings.Index(s, "="); i > 0 {
+                n.key = strings.TrimSpace(s[:i])
+                n.value = strings.TrimSpace(s[i+1:])
+            }
+        }
+
+        n.section = section
+        lines = append(lines, n)
+    }
+    return lines
+}
+
+func readBootConfig() ([]configLine, error) {
+    b, err := ioutil.ReadFile(bootConfigPath())
+    if err != nil {
+        return nil, err
+    }
+    return parseBootConfig(string(b)), nil
+}
+
+func backupBootConfig() error {
+    if _, err := os.Stat(bootConfigBackupPath); err == nil {
+        return nil
+    }
+
+    b, err := ioutil.ReadFile(bootConfigPath())
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(bootConfigBackupPath), 0755); err != nil {
+        return err
+    }
+    return ioutil.WriteFile(bootConfigBackupPath, b, 0644)
+}
+
+func writeBootConfigFile(b []byte) error {
+    path := bootConfigPath()
+    tmp := path + ".pnpi-tmp"
+    if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    return nil
+}
+
+// The backup is the file the system booted with, unless hardware toggles
+// changed it first, and those mark a reboot themselves. A reboot is due only
+// while the file differs from it, so a revert, or undoing a change by hand,
+// clears it.
+func bootConfigChanged() bool {
+    was, err := ioutil.ReadFile(bootConfigBackupPath)
+    if err != nil {
+        return false
+    }
+    now, err := ioutil.ReadFile(bootConfigPath())
+    return err != nil || !bytes.Equal(was, now)
+}
+
+func writeBootConfig(lines []configLine) error {
+    if err := backupBootConfig(); err != nil {
+        return err
+    }
+
+    var b strings.Builder
+    for _,n := range lines {
+        b.WriteString(n.text + "\n")
+    }
+    return writeBootConfigFile([]byte(b.String()))
+}
+
+// After the last non-blank line of the section. A missing section is added at
+// the end.
+func insertConfigLine(lines []configLine, section string, text string) []configLine {
+    at, found := -1, section == ""
+    for i := range lines {
+        if lines[i].section == section {
+            found = true
+            if strings.TrimSpace(lines[i].text) != "" {
+                at = i
+            }
+        }
+    }
+
+    n := configLine{text: text, section: section}
+    if !found {
+        lines = append(lines, configLine{text: ""}, configLine{text: "[" + section + "]", section: section})
+        at = len(lines) - 1
+    }
+
+    lines = append(lines, configLine{})
+    copy(lines[at+2:], lines[at+1:])
+    lines[at+1] = n
+    return lines
+}
+
+func validateConfigKey(section, key string) error {
+    if section != "" && !sectionPattern.MatchString(section) {
+        return fmt.Errorf("Invalid section: %v", section)
+    }
+    if _, ok := bootConfigKeys[key]; !ok {
+        return fmt.Errorf("Unsupported key: %v", key)
+    }
+    return nil
+}
+
+func validateConfigSetting(section, key, value string) error {
+    if err := validateConfigKey(section, key); err != nil {
+        return err
+    }
+    if err := bootConfigKeys[key](value); err != nil {
+        return fmt.Errorf("Invalid value for %v: %v", key, err)
+    }
+    return nil
+}
+
+// A single-valued key replaces any existing setting in the section. dtoverlay
+// and dtparam are added, unless already present.
+func SetBootConfig(section, key, value string) error {
+    if err := validateConfigSetting(section, key, value); err != nil {
+        return err
+    }
+
+    lines, err := readBootConfig()
+    if err != nil {
+        return err
+    }
+
+    text := key + "=" + value
+    replaced := false
+    var result []configLine
+    for _,n := range lines {
+        if n.isEntry() && n.section == section && n.key == key {
+            if isMultiKey(key) {
+                if n.value == value {
+                    return nil
+                }
+            } else if replaced {
+                continue
+            } else {
+                if n.value == value {
+                    return nil
+                }
+                n.text, n.value = text, value
+                replaced = true
+            }
+        }
+        result = append(result, n)
+    }
+
+    if !replaced {
+        result = insertConfigLine(result, section, text)
+    }
+    return writeBootConfig(result)
+}
+
+// Value may be empty to remove all settings of the key in the section.
+func RemoveBootConfig(section, key, value string) error {
+    if err := validateConfigKey(section, key); err != nil {
+        return err
+    }
+
+    lines, err := readBootConfig()
+    if err != nil {
+        return err
+    }
+
+    var result []configLine
+    for _,n := range lines {
+        if n.isEntry() && n.section == section && n.key == key &&
+                (value == "" || n.value == value) {
+            continue
+        }
+        result = append(result, n)
+    }
+
+    if len(result) == len(lines) {
+        return fmt.Errorf("No such setting: %v", key)
+    }
+    return writeBootConfig(result)
+}
+
+func RevertBootConfig() error {
+    b, err := ioutil.ReadFile(bootConfigBackupPath)
+    if os.IsNotExist(err) {
+        return fmt.Errorf("No changes to revert")
+    }
+    if err != nil {
+        return err
+    }
+
+    if err := writeBootConfigFile(b); err != nil {
+        return err
+    }
+    return os.Remove(bootConfigBackupPath)
+}
+
+func RetrieveBootConfig() *BootConfigReport {
+    r := NewBootConfigReport()
+
+    lines, err := readBootConfig()
+    if err != nil {
+        LogDebug("Cannot read config.txt:", err)
+    }
+
+    for i,n := range lines {
+        if i == 0 || n.section != lines[i-1].section {
+            r.Sections = append(r.Sections, ConfigSection{n.section, make([]ConfigEntry, 0)})
+        }
+        if n.isEntry() {
+            s := &r.Sections[len(r.Sections)-1]
+            s.Entries = append(s.Entries, ConfigEntry{n.key, n.value})
+        }
+    }
+
+    _, err = os.Stat(bootConfigBackupPath)
+    r.Revertible = (err == nil)
+    r.RebootRequired = RebootRequired()
+    return r
+}
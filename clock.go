@@ -0,0 +1,90 @@
+package main
+
+import (
+    "fmt"
+    "os/exec"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// Set clock from client even if it is synchronised
+var forceTime = false
+
+func SetForceTime(b bool) {
+    forceTime = b
+}
+
+const (
+    timeError = 5        // clock state TIME_ERROR
+    staUnsync = 0x0040   // status bit STA_UNSYNC
+)
+
+// Whether kernel clock is disciplined by NTP (or systemd-timesyncd)
+func NtpSynchronized() bool {
+    var tx syscall.Timex
+    state, err := syscall.Adjtimex(&tx)
+    if err != nil {
+        LogDebug("Cannot obtain clock state:", err)
+        return false
+    }
+    return state != timeError && tx.Status & staUnsync == 0
+}
+
+// Either Unix seconds, or RFC 3339
+func parseClientTime(s string) (time.Time, error) {
+    if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+        return time.Unix(n, 0), nil
+    }
+    return time.Parse(time.RFC3339, s)
+}
+
+func setClock(t time.Time) error {
+    tv := syscall.NsecToTimeval(t.UnixNano())
+    if err := syscall.Settimeofday(&tv); err != nil {
+        return err
+    }
+
+    // Pi has no RTC. fake-hwclock restores the last saved time on boot.
+    if path, err := exec.LookPath("fake-hwclock"); err == nil {
+        exec.Command(path, "save").Run()
+    }
+    return nil
+}
+
+func SetTimezone(name string) error {
+    if name == "" || strings.Contains(name, "..") {
+        return fmt.Errorf("Invalid timezone: %v", name)
+    }
+    if _, err := time.LoadLocation(name); err != nil {
+        return fmt.Errorf("Unknown timezone: %v", name)
+    }
+    _, err := raspi_config("do_change_timezone", name)
+    return err
+}
+
+// Clock is only set if not synchronised, unless forced. Either argument may be
+// empty.
+func SetSystemTime(utc string, timezone string) error {
+    if utc != "" {
+        t, err := parseClientTime(utc)
+        if err != nil {
+            return fmt.Errorf("Invalid time: %v", utc)
+        }
+
+        if forceTime || !NtpSynchronized() {
+            LogInfo("Setting clock to", t.UTC())
+            if err = setClock(t); err != nil {
+                return err
+            }
+        } else {
+            LogDebug("Clock is synchronised, not setting it")
+        }
+    }
+
+    if timezone != "" {
+        return SetTimezone(timezone)
+    }
+    return nil
+}
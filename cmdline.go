@@ -1,6 +1,8 @@
 package main
 
 import (
+    "fmt"
+    "regexp"
     "strings"
     "os"
     "os/exec"
@@ -41,6 +43,13 @@ func service_functions(name string) (string, string) {
     }
 }
 
+func serviceIsKnown(name string) bool {
+    switch name {
+    case "SSH", "VNC": return true
+    default: return false
+    }
+}
+
 func HaltSystem() error {
     return exec.Command("halt", "-h").Run()
 }
@@ -61,8 +70,13 @@ func StopService(name string) error {
     return err
 }
 
-func WifiConnect(ssid string, passphrase string) error {
-    _, err := raspi_config("do_wifi_ssid_passphrase", ssid, passphrase)
+// A 64-hex-digit passphrase is taken as a precomputed PSK.
+func WifiConnect(ssid string, passphrase string, hidden bool) error {
+    scanSsid := "0"
+    if hidden {
+        scanSsid = "1"
+    }
+    _, err := raspi_config("do_wifi_ssid_passphrase", ssid, passphrase, scanSsid)
     return err
 }
 
@@ -96,6 +110,28 @@ func ReportSsid(name string) (string, error) {
     return strings.TrimSuffix(string(out), "\n"), err
 }
 
+// Key-value pairs of `wpa_cli status`
+func WifiStatus() (map[string]string, error) {
+    status := make(map[string]string)
+    out, err := raspi_config("get_wifi_status")
+    if err != nil {
+        return status, err
+    }
+
+    for _,n := range strings.Split(strings.TrimSpace(out), "\n") {
+        kv := strings.SplitN(n, "=", 2)
+        if len(kv) == 2 {
+            status[kv[0]] = kv[1]
+        }
+    }
+    return status, err
+}
+
+func SaveWifiConfig() error {
+    _, err := raspi_config("save_wifi_config")
+    return err
+}
+
 func WifiCountryCode() (string, error) {
     out, err := raspi_config("get_wifi_country")
     if err != nil {
@@ -120,6 +156,17 @@ func AvailableWifiCountries() ([]Country, error) {
     return countries, err
 }
 
+// RFC 1123 hostname label, which is what mDNS can advertise as NAME.local
+var hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+func SetHostname(name string) error {
+    if !hostnamePattern.MatchString(name) {
+        return fmt.Errorf("Invalid hostname: %v", name)
+    }
+    _, err := raspi_config("do_hostname", name)
+    return err
+}
+
 func SetWifiCountry(code string) error {
     _, err := raspi_config("do_wifi_country", code)
     return err
@@ -1,24 +1,103 @@
 package main
 
-import  "fmt"
+import (
+    "fmt"
+    "time"
+)
+
+const (
+    FamilyIPv4 = "ipv4"
+    FamilyIPv6 = "ipv6"
+)
+
+const (
+    ScopeGlobal = "global"
+    ScopeLink = "link"
+    ScopeHost = "host"
+)
+
+type Address struct {
+    IP string      `json:"ip"`
+    Prefix int     `json:"prefix"`
+    Family string  `json:"family"`
+    Scope string   `json:"scope"`
+}
 
 type NetworkInterface struct {
-    Name string    `json:"name"`
-    IPs *StringSet `json:"ip,omitempty"`
-    SSID string    `json:"ssid,omitempty"`
-    WiFi bool      `json:"wifi"`
+    Name string           `json:"name"`
+    IPs *StringSet        `json:"ip,omitempty"`  // for older clients, same as Addresses
+    Addresses []Address   `json:"addresses,omitempty"`
+    MAC string            `json:"mac,omitempty"`
+    OperState string      `json:"operstate,omitempty"`
+    Carrier bool          `json:"carrier"`
+    Speed int             `json:"speed,omitempty"`  // Mbit/s
+    SSID string           `json:"ssid,omitempty"`
+    WiFi bool             `json:"wifi"`
 }
 
+// Addresses are expected in the same order, as gatherInterfaces() sorts them.
 func (i NetworkInterface) Equal(j NetworkInterface) bool {
+    if len(i.Addresses) != len(j.Addresses) {
+        return false
+    }
+    for n := range i.Addresses {
+        if i.Addresses[n] != j.Addresses[n] {
+            return false
+        }
+    }
+
     return i.Name == j.Name &&
            i.IPs.Equal(j.IPs) &&
+           i.MAC == j.MAC &&
+           i.OperState == j.OperState &&
+           i.Carrier == j.Carrier &&
+           i.Speed == j.Speed &&
            i.SSID == j.SSID &&
            i.WiFi == j.WiFi
 }
 
 type Service struct {
-    Name string  `json:"name"`
-    Running bool `json:"running"`
+    Name string        `json:"name"`
+    Running bool       `json:"running"`
+    HostKeys []SshKey  `json:"host_keys,omitempty"`
+    Remaining int64    `json:"remaining,omitempty"`  // seconds until stopped automatically
+    deadline time.Time
+}
+
+func NewService(name string, running bool, hostKeys []SshKey) Service {
+    s := Service{Name: name, Running: running, HostKeys: hostKeys}
+    if s.deadline = ServiceDeadline(name); !s.deadline.IsZero() {
+        if s.Remaining = int64(time.Until(s.deadline) / time.Second); s.Remaining < 1 {
+            s.Remaining = 1
+        }
+    }
+    return s
+}
+
+func (s Service) Equal(t Service) bool {
+    // Remaining time goes down all the time. Only a new deadline is a change.
+    if s.Name != t.Name || s.Running != t.Running || !s.deadline.Equal(t.deadline) ||
+            len(s.HostKeys) != len(t.HostKeys) {
+        return false
+    }
+    for i := range s.HostKeys {
+        if s.HostKeys[i] != t.HostKeys[i] {
+            return false
+        }
+    }
+    return true
+}
+
+type Route struct {
+    Interface string  `json:"interface"`
+    Gateway string    `json:"gateway"`
+    Family string     `json:"family"`
+    Metric int        `json:"metric"`
+}
+
+type Reachability struct {
+    Status string  `json:"status"`
+    Target string  `json:"target,omitempty"`
 }
 
 type SystemStates struct {
@@ -26,10 +105,34 @@ type SystemStates struct {
     Interfaces []NetworkInterface `json:"interfaces"`
     Services []Service            `json:"services"`
     WifiCountryCode string        `json:"wifi_country_code"`
+    Routes []Route                `json:"routes"`
+    DnsServers []string           `json:"dns"`
+    Reachability *Reachability    `json:"reachability"`
+    Hostname string               `json:"hostname"`
+    MdnsName string               `json:"mdns_name"`
+    NtpSynchronized bool          `json:"ntp_synchronized"`
 }
 
-func NewSystemStates(nis []NetworkInterface, ss []Service, wc string) *SystemStates {
-    return &SystemStates { "states", nis, ss, wc }
+func NewSystemStates(r *MonitorReport) *SystemStates {
+    return &SystemStates {
+        "states",
+        r.Interfaces,
+        r.Services,
+        r.WifiCountryCode,
+        r.Routes,
+        r.DnsServers,
+        r.Reachability,
+        r.Hostname,
+        mdnsName(r.Hostname),
+        r.NtpSynchronized,
+    }
+}
+
+func mdnsName(hostname string) string {
+    if hostname == "" {
+        return ""
+    }
+    return hostname + ".local"
 }
 
 type SystemStatesChange struct {
@@ -39,16 +142,58 @@ type SystemStatesChange struct {
     WifiCountryCode string        `json:"wifi_country_code"`
     // WifiCountryCode: Don't omitempty, may want to pass empty string.
     // Because it's always present, the field should always contain the latest country code.
+    // Same for routes, DNS servers, reachability, hostname and NTP status below.
+    Routes []Route                `json:"routes"`
+    DnsServers []string           `json:"dns"`
+    Reachability *Reachability    `json:"reachability"`
+    Hostname string               `json:"hostname"`
+    MdnsName string               `json:"mdns_name"`
+    NtpSynchronized bool          `json:"ntp_synchronized"`
 }
 
-func NewSystemStatesChange(nis []NetworkInterface, ss []Service, wc string) *SystemStatesChange {
-    return &SystemStatesChange { "change", nis, ss, wc }
+func NewSystemStatesChange(r *MonitorReport) *SystemStatesChange {
+    return &SystemStatesChange {
+        "change",
+        r.Interfaces,
+        r.Services,
+        r.WifiCountryCode,
+        r.Routes,
+        r.DnsServers,
+        r.Reachability,
+        r.Hostname,
+        mdnsName(r.Hostname),
+        r.NtpSynchronized,
+    }
+}
+
+const (
+    SecurityOpen = "open"
+    SecurityWEP = "wep"
+    SecurityPSK = "psk"
+    SecurityEAP = "eap"
+)
+
+const (
+    Band2GHz = "2.4"
+    Band5GHz = "5"
+)
+
+type BSS struct {
+    BSSID string    `json:"bssid"`
+    Signal int      `json:"signal"`
+    Frequency int   `json:"frequency"`
 }
 
 type Hotspot struct {
-    SSID string  `json:"ssid"`
-    Open bool    `json:"open"`
-    Signal int   `json:"signal"`
+    SSID string      `json:"ssid"`
+    Open bool        `json:"open"`
+    Security string  `json:"security"`
+    Signal int       `json:"signal"`
+    Count int        `json:"count"`
+    Bands []string   `json:"bands"`
+    Connected bool   `json:"connected"`
+    Saved bool       `json:"saved"`
+    BSSes []BSS      `json:"bss,omitempty"`
 }
 
 type ScanResult struct {
@@ -60,6 +205,25 @@ func NewScanResult(hs []Hotspot) *ScanResult {
     return &ScanResult { "scan", hs }
 }
 
+type SavedNetwork struct {
+    ID string          `json:"-"`
+    SSID string        `json:"ssid"`
+    Priority int       `json:"priority"`
+    Security string    `json:"security"`
+    Autoconnect bool   `json:"autoconnect"`
+    Current bool       `json:"current"`
+    Failing bool       `json:"failing"`
+}
+
+type SavedNetworks struct {
+    Type string              `json:"type"`
+    Networks []SavedNetwork  `json:"networks"`
+}
+
+func NewSavedNetworks(ns []SavedNetwork) *SavedNetworks {
+    return &SavedNetworks { "saved", ns }
+}
+
 type Country struct {
     Code string `json:"code"`
     Name string `json:"name"`
@@ -74,11 +238,220 @@ func NewSystemChoices(cs []Country) *SystemChoices {
     return &SystemChoices { "choices", cs }
 }
 
+type DeviceInfo struct {
+    Type string             `json:"type"`
+    Model string            `json:"model"`
+    Serial string           `json:"serial"`
+    Revision string         `json:"revision"`
+    OS string               `json:"os"`
+    Kernel string           `json:"kernel"`
+    Uptime int64            `json:"uptime"`  // seconds
+    ServerVersion string    `json:"server_version"`
+    ProtocolVersion string  `json:"protocol_version"`
+}
+
+type Throttle struct {
+    UnderVoltage bool     `json:"under_voltage"`
+    FrequencyCapped bool  `json:"frequency_capped"`
+    Throttled bool        `json:"throttled"`
+    SoftTempLimit bool    `json:"soft_temp_limit"`
+}
+
+type HealthReport struct {
+    Type string           `json:"type"`
+    Temperature float64   `json:"temperature"`    // Celsius
+    CpuFrequency int      `json:"cpu_frequency"`  // MHz
+    Now Throttle          `json:"now"`
+    SinceBoot Throttle    `json:"since_boot"`
+}
+
+// In bytes
+type Usage struct {
+    Total uint64  `json:"total"`
+    Free uint64   `json:"free"`
+}
+
+type Traffic struct {
+    Name string       `json:"name"`
+    RxBytes uint64    `json:"rx_bytes"`
+    TxBytes uint64    `json:"tx_bytes"`
+}
+
+type ResourcesReport struct {
+    Type string           `json:"type"`
+    Load [3]float64       `json:"load"`
+    Memory Usage          `json:"memory"`
+    Swap Usage            `json:"swap"`
+    Disk Usage            `json:"disk"`
+    Traffic []Traffic     `json:"traffic"`
+}
+
+const (
+    AlertUnderVoltage = "under_voltage"
+)
+
+type Alert struct {
+    Type string     `json:"type"`
+    Kind string     `json:"kind"`
+    Message string  `json:"message"`
+}
+
+func NewAlert(kind string, message string) *Alert {
+    return &Alert { "alert", kind, message }
+}
+
+type HardwareInterface struct {
+    Name string    `json:"name"`
+    Enabled bool   `json:"enabled"`
+}
+
+type HardwareReport struct {
+    Type string                       `json:"type"`
+    Interfaces []HardwareInterface    `json:"interfaces"`
+    RebootRequired bool               `json:"reboot_required"`
+}
+
+func NewHardwareReport() *HardwareReport {
+    return &HardwareReport { "hardware", make([]HardwareInterface, 0), false }
+}
+
+type ConfigEntry struct {
+    Key string    `json:"key"`
+    Value string  `json:"value"`
+}
+
+type ConfigSection struct {
+    Name string             `json:"name"`
+    Entries []ConfigEntry   `json:"entries"`
+}
+
+type BootConfigReport struct {
+    Type string                `json:"type"`
+    Sections []ConfigSection   `json:"sections"`
+    Revertible bool            `json:"revertible"`
+    RebootRequired bool        `json:"reboot_required"`
+}
+
+func NewBootConfigReport() *BootConfigReport {
+    return &BootConfigReport { "boot_config", make([]ConfigSection, 0), false, false }
+}
+
+type ShellExit struct {
+    Type string      `json:"type"`
+    Channel uint16   `json:"channel"`
+    Status int       `json:"status"`
+    Signal string    `json:"signal,omitempty"`
+}
+
+func NewShellExit(status int) *ShellExit {
+    return &ShellExit { "shell_exit", 0, status, "" }
+}
+
+// A command not executed, e.g. because the executor is busy
+type CommandRejected struct {
+    Type string    `json:"type"`
+    Action string  `json:"action"`
+    Reason string  `json:"reason"`
+}
+
+func NewCommandRejected(action string, reason string) *CommandRejected {
+    return &CommandRejected { "rejected", action, reason }
+}
+
+type SecurityReport struct {
+    Type string                    `json:"type"`
+    DefaultPasswordUsers []string  `json:"default_password_users"`
+    PasswordChangeRequired bool    `json:"password_change_required"`
+    PasswordChangeByServer bool    `json:"password_change_by_server"`
+    PasswordAuthentication bool    `json:"password_authentication"`
+}
+
+type SshKey struct {
+    KeyType string      `json:"key_type"`
+    Fingerprint string  `json:"fingerprint"`
+    Comment string      `json:"comment"`
+    line string         // normalized, as written to authorized_keys
+}
+
+type SshKeysReport struct {
+    Type string    `json:"type"`
+    User string    `json:"user"`
+    Keys []SshKey  `json:"keys"`
+}
+
+func NewSshKeysReport(user string) *SshKeysReport {
+    return &SshKeysReport { "ssh_keys", user, make([]SshKey, 0) }
+}
+
+type Progress struct {
+    Type string    `json:"type"`
+    Action string  `json:"action"`
+    Stage string   `json:"stage"`
+    SSID string    `json:"ssid,omitempty"`
+    Done bool      `json:"done"`
+    Error string   `json:"error,omitempty"`
+    Reason string  `json:"reason,omitempty"`
+}
+
+func NewProgress(action string, stage string) *Progress {
+    return &Progress { Type: "progress", Action: action, Stage: stage }
+}
+
+func NewProgressFailure(action string, err error) *Progress {
+    return &Progress { Type: "progress", Action: action, Stage: StageFailed, Done: true, Error: err.Error() }
+}
+
+const (
+    OutcomeCommitted = "committed"
+    OutcomeRolledBack = "rolled_back"
+    OutcomeRollbackFailed = "rollback_failed"
+)
+
+type Transaction struct {
+    Type string     `json:"type"`
+    Action string   `json:"action"`
+    SSID string     `json:"ssid"`
+    Outcome string  `json:"outcome"`
+    Error string    `json:"error,omitempty"`
+}
+
+func NewTransaction(action string, ssid string, outcome string, err error) *Transaction {
+    t := &Transaction { Type: "transaction", Action: action, SSID: ssid, Outcome: outcome }
+    if err != nil {
+        t.Error = err.Error()
+    }
+    return t
+}
+
 type Command struct {
     Action string `json:"action"`
     Args []string `json:"args,omitempty"`
 }
 
+// Optional arguments are allowed to be missing.
+func (c *Command) Arg(i int) string {
+    if i < len(c.Args) {
+        return c.Args[i]
+    }
+    return ""
+}
+
+// Positions of arguments holding passwords, kept out of logs
+var secretArgs = map[string][]int{
+    "connect": {1},
+    "connect_enterprise": {4},
+    "passwd": {1},
+}
+
 func (c *Command) String() string {
-    return fmt.Sprintf("{%v %v}", c.Action, c.Args)
+    args := c.Args
+    if secrets, ok := secretArgs[c.Action]; ok {
+        args = append([]string(nil), c.Args...)
+        for _,i := range secrets {
+            if i < len(args) {
+                args[i] = "******"
+            }
+        }
+    }
+    return fmt.Sprintf("{%v %v}", c.Action, args)
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// Where deadlines are kept across restarts
+var stateDirectory = "/var/lib/pnpi"
+
+func SetStateDirectory(dir string) {
+    stateDirectory = dir
+}
+
+func deadlinesPath() string {
+    return filepath.Join(stateDirectory, "deadlines.json")
+}
+
+// Times from time.Now() carry a monotonic reading, so a clock set by NTP or
+// the phone does not move them. Only the file has wall-clock time.
+type serviceDeadline struct {
+    at time.Time
+    limit time.Duration        // at most this long after a restart
+}
+
+// As kept in the file. Seconds.
+type savedDeadline struct {
+    Deadline int64  `json:"deadline"`
+    Limit int64     `json:"limit"`
+}
+
+// Services to be stopped automatically
+var deadlines = make(map[string]serviceDeadline)
+var deadlinesLock sync.Mutex
+
+func saveDeadlines() {
+    saved := make(map[string]savedDeadline)
+    for name, d := range deadlines {
+        saved[name] = savedDeadline{d.at.Unix(), int64(d.limit / time.Second)}
+    }
+    b,_ := json.Marshal(saved)
+
+    if err := os.MkdirAll(stateDirectory, 0700); err != nil {
+        LogDebug("Cannot save deadlines:", err)
+        return
+    }
+    tmp := deadlinesPath() + ".tmp"
+    if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+        LogDebug("Cannot save deadlines:", err)
+        return
+    }
+    if err := os.Rename(tmp, deadlinesPath()); err != nil {
+        LogDebug("Cannot save deadlines:", err)
+    }
+}
+
+func RestoreDeadlines() {
+    b, err := ioutil.ReadFile(deadlinesPath())
+    if err != nil {
+        if !os.IsNotExist(err) {
+            LogDebug("Cannot restore deadlines:", err)
+        }
+        return
+    }
+
+    deadlinesLock.Lock()
+    defer deadlinesLock.Unlock()
+
+    restored := make(map[string]savedDeadline)
+    if err := json.Unmarshal(b, &restored); err != nil {
+        LogInfo("Cannot restore deadlines:", err)
+        return
+    }
+
+    // The file may be stale or corrupt. Stopping an unknown service panics.
+    //
+    // The clock may have been put back after a reboot, e.g. by fake-hwclock,
+    // or forward by NTP. Never allow longer than was left when last saved.
+    now := time.Now()
+    for name, r := range restored {
+        if !serviceIsKnown(name) {
+            LogInfo("Dropping deadline of unknown service:", name)
+            continue
+        }
+
+        left := time.Unix(r.Deadline, 0).Sub(now)
+        limit := time.Duration(r.Limit) * time.Second
+        if left > limit {
+            LogInfo("Clock moved back, limiting deadline of", name, "to", limit)
+            left = limit
+        }
+        if left < 0 {
+            left = 0
+        }
+        deadlines[name] = serviceDeadline{now.Add(left), left}
+    }
+    saveDeadlines()
+}
+
+func SetServiceDeadline(name string, d time.Duration) {
+    deadlinesLock.Lock()
+    defer deadlinesLock.Unlock()
+
+    deadlines[name] = serviceDeadline{time.Now().Add(d), d}
+    saveDeadlines()
+}
+
+func ClearServiceDeadline(name string) {
+    deadlinesLock.Lock()
+    defer deadlinesLock.Unlock()
+
+    if _, ok := deadlines[name]; ok {
+        delete(deadlines, name)
+        saveDeadlines()
+    }
+}
+
+// Zero if none
+func ServiceDeadline(name string) time.Time {
+    deadlinesLock.Lock()
+    defer deadlinesLock.Unlock()
+
+    return deadlines[name].at
+}
+
+func expireServices() {
+    defer RecoverDo(
+        func(x interface{}) {
+            LogInfo("Cannot expire services:", x)
+        },
+        func() {},
+    )
+
+    now := time.Now()
+
+    expired := make(map[string]time.Time)
+    deadlinesLock.Lock()
+    for name, d := range deadlines {
+        if !d.at.After(now) {
+            expired[name] = d.at
+        }
+    }
+    deadlinesLock.Unlock()
+
+    // If stopping fails, the deadline stays and it is tried again.
+    for name, t := range expired {
+        LogInfo("Time is up for", name)
+        if err := StopService(name); err != nil {
+            LogDebug("Cannot stop", name, "-", err)
+            continue
+        }
+
+        // Unless a new deadline has been set meanwhile
+        deadlinesLock.Lock()
+        if deadlines[name].at.Equal(t) {
+            delete(deadlines, name)
+            saveDeadlines()
+        }
+        deadlinesLock.Unlock()
+    }
+}
+
+// Runs for the life of the process, not of a session, so services are stopped
+// even when no phone is attached. A panic only loses one round.
+func ExpireServices() {
+    for {
+        expireServices()
+        time.Sleep(5 * time.Second)
+    }
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+    "strconv"
+    "strings"
+)
+
+// Key-value lines such as those in /proc/cpuinfo ("Key : value") and
+// /etc/os-release (KEY="value")
+func parseKeyValues(text string, sep string) map[string]string {
+    m := make(map[string]string)
+    for _,n := range strings.Split(text, "\n") {
+        kv := strings.SplitN(n, sep, 2)
+        if len(kv) == 2 {
+            m[strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+        }
+    }
+    return m
+}
+
+func RetrieveDevice() *DeviceInfo {
+    d := &DeviceInfo{
+            Type: "device",
+            ServerVersion: ServerVersion,
+            ProtocolVersion: AoaProtocolVersion}
+
+    cpuinfo, err := readSysFile("/proc/cpuinfo")
+    if err != nil {
+        LogDebug("Cannot read cpuinfo:", err)
+    }
+    cpu := parseKeyValues(cpuinfo, ":")
+    d.Serial, d.Revision = cpu["Serial"], cpu["Revision"]
+
+    // Device tree string is NUL-terminated
+    if model, err := readSysFile("/proc/device-tree/model"); err == nil {
+        d.Model = strings.TrimRight(model, "\x00")
+    } else {
+        d.Model = cpu["Model"]
+    }
+
+    if release, err := readSysFile("/etc/os-release"); err == nil {
+        d.OS = parseKeyValues(release, "=")["PRETTY_NAME"]
+    } else {
+        LogDebug("Cannot read os-release:", err)
+    }
+
+    if kernel, err := readSysFile("/proc/sys/kernel/osrelease"); err == nil {
+        d.Kernel = kernel
+    } else {
+        LogDebug("Cannot read kernel release:", err)
+    }
+
+    if uptime, err := readSysFile("/proc/uptime"); err == nil {
+        f := strings.Fields(uptime)
+        if len(f) > 0 {
+            seconds,_ := strconv.ParseFloat(f[0], 64)
+            d.Uptime = int64(seconds)
+        }
+    } else {
+        LogDebug("Cannot read uptime:", err)
+    }
+    return d
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/hex"
+    "encoding/pem"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+)
+
+type EnterpriseCredentials struct {
+    SSID string
+    Method string             // PEAP, TTLS
+    Identity string
+    AnonymousIdentity string
+    Password string
+    Phase2 string             // MSCHAPV2, PAP, ...
+    CACert string             // PEM, optional
+    DomainMatch string        // optional
+}
+
+// Inner authentication methods each outer method supports
+var enterprisePhase2 = map[string][]string{
+    "PEAP": {"MSCHAPV2", "GTC", "MD5"},
+    "TTLS": {"MSCHAPV2", "MSCHAP", "PAP", "CHAP"},
+}
+
+const caCertDirectory = "/etc/wpa_supplicant/pnpi-ca"
+
+func (c *EnterpriseCredentials) Validate() error {
+    phase2s, ok := enterprisePhase2[c.Method]
+    if !ok {
+        return fmt.Errorf("Unsupported EAP method: %v", c.Method)
+    }
+
+    if c.SSID == "" {
+        return fmt.Errorf("No SSID")
+    }
+
+    if c.Identity == "" {
+        return fmt.Errorf("No identity")
+    }
+
+    if c.Phase2 != "" && !containString(phase2s, c.Phase2) {
+        return fmt.Errorf("Unsupported phase2 method for %v: %v", c.Method, c.Phase2)
+    }
+
+    if c.CACert != "" {
+        block,_ := pem.Decode([]byte(c.CACert))
+        if block == nil || block.Type != "CERTIFICATE" {
+            return fmt.Errorf("CA certificate is not PEM-encoded")
+        }
+        if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+            return fmt.Errorf("Invalid CA certificate: %v", err)
+        }
+    }
+    return nil
+}
+
+// Store CA certificate where wpa_supplicant can read it. File is named by
+// content, so re-sending the same certificate does not pile up copies.
+func storeCACert(cert string) (string, error) {
+    if err := os.MkdirAll(caCertDirectory, 0755); err != nil {
+        return "", err
+    }
+
+    sum := sha256.Sum256([]byte(cert))
+    path := filepath.Join(caCertDirectory, hex.EncodeToString(sum[:8]) + ".pem")
+    return path, ioutil.WriteFile(path, []byte(cert), 0644)
+}
+
+func WifiConnectEnterprise(c *EnterpriseCredentials) error {
+    if err := c.Validate(); err != nil {
+        return err
+    }
+
+    caPath := ""
+    if c.CACert != "" {
+        var err error
+        if caPath, err = storeCACert(c.CACert); err != nil {
+            return err
+        }
+    }
+
+    _, err := raspi_config("do_wifi_enterprise",
+                           c.SSID,
+                           c.Method,
+                           c.Identity,
+                           c.AnonymousIdentity,
+                           c.Password,
+                           c.Phase2,
+                           caPath,
+                           c.DomainMatch)
+    return err
+}
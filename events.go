@@ -0,0 +1,309 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync/atomic"
+    "syscall"
+    "time"
+    "unsafe"
+)
+
+// Signal without blocking. A pending signal is as good as many.
+func signalEvent(events chan<- bool) {
+    select {
+    case events <- true:
+    default:
+    }
+}
+
+func isDone(done <-chan struct{}) bool {
+    select {
+    case <-done:
+        return true
+    default:
+        return false
+    }
+}
+
+// Multicast groups from <linux/rtnetlink.h>, not in package syscall
+const (
+    rtmgrpLink = 0x1
+    rtmgrpIPv4Ifaddr = 0x10
+    rtmgrpIPv4Route = 0x40
+    rtmgrpIPv6Ifaddr = 0x100
+    rtmgrpIPv6Route = 0x400
+)
+
+const rtnetlinkGroups = rtmgrpLink |
+                        rtmgrpIPv4Ifaddr |
+                        rtmgrpIPv4Route |
+                        rtmgrpIPv6Ifaddr |
+                        rtmgrpIPv6Route
+
+type linkState struct {
+    flags uint32
+    operstate byte
+}
+
+// wpa_supplicant's background scans send RTM_NEWLINK carrying wireless
+// extension events many times a minute. Only a new link, or a change of flags
+// or operstate, counts.
+func linkChanged(links map[int32]linkState, m *syscall.NetlinkMessage) bool {
+    if len(m.Data) < syscall.SizeofIfInfomsg {
+        return true
+    }
+    info := (*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+    attrs, err := syscall.ParseNetlinkRouteAttr(m)
+    if err != nil {
+        return true
+    }
+
+    was, seen := links[info.Index]
+    now := linkState{flags: info.Flags, operstate: was.operstate}
+    for _,a := range attrs {
+        switch a.Attr.Type {
+        case syscall.IFLA_WIRELESS:
+            return false
+        case syscall.IFLA_OPERSTATE:
+            if len(a.Value) > 0 {
+                now.operstate = a.Value[0]
+            }
+        }
+    }
+    links[info.Index] = now
+    return !seen || now != was
+}
+
+// Subscribe to rtnetlink notifications of link, address and route changes.
+// Returned channel is closed when notifications stop, at once if subscription
+// fails, in which case caller should poll.
+func WatchNetlink(events chan<- bool, done <-chan struct{}) <-chan struct{} {
+    lost := make(chan struct{})
+
+    fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW | syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+    if err != nil {
+        LogInfo("Cannot open netlink socket:", err)
+        close(lost)
+        return lost
+    }
+
+    err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: rtnetlinkGroups})
+    if err != nil {
+        syscall.Close(fd)
+        LogInfo("Cannot subscribe to netlink:", err)
+        close(lost)
+        return lost
+    }
+
+    // Wake up every second to check if I should stop
+    tv := syscall.NsecToTimeval(int64(time.Second))
+    if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+        syscall.Close(fd)
+        LogInfo("Cannot set netlink timeout:", err)
+        close(lost)
+        return lost
+    }
+
+    go func() {
+        defer close(lost)
+        defer syscall.Close(fd)
+        buf := make([]byte, syscall.Getpagesize())
+        links := make(map[int32]linkState)
+
+        for !isDone(done) {
+            n, _, err := syscall.Recvfrom(fd, buf, 0)
+            if err == syscall.EAGAIN || err == syscall.EINTR {
+                continue
+            }
+            if err == syscall.ENOBUFS {
+                // Missed some. Something has changed anyway.
+                signalEvent(events)
+                continue
+            }
+            if err != nil {
+                LogInfo("Netlink watcher terminates due to:", err)
+                return
+            }
+
+            msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+            if err != nil {
+                continue
+            }
+
+            for _,m := range msgs {
+                switch m.Header.Type {
+                case syscall.RTM_NEWLINK:
+                    if linkChanged(links, &m) {
+                        signalEvent(events)
+                    }
+                case syscall.RTM_DELLINK:
+                    if len(m.Data) >= syscall.SizeofIfInfomsg {
+                        delete(links, (*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0])).Index)
+                    }
+                    signalEvent(events)
+                case syscall.RTM_NEWADDR, syscall.RTM_DELADDR,
+                     syscall.RTM_NEWROUTE, syscall.RTM_DELROUTE:
+                    signalEvent(events)
+                }
+            }
+        }
+    }()
+    return lost
+}
+
+const wpaControlDirectory = "/var/run/wpa_supplicant"
+
+// Events meaning the SSID may have changed
+var wpaEvents = []string{
+    "CTRL-EVENT-CONNECTED",
+    "CTRL-EVENT-DISCONNECTED",
+    "CTRL-EVENT-SSID-TEMP-DISABLED",
+    "CTRL-EVENT-TERMINATING",
+}
+
+// Each attachment needs its own local name, as several may be made at once.
+var supplicantAttachments int32
+
+func attachSupplicant(iface string) (*net.UnixConn, error) {
+    seq := atomic.AddInt32(&supplicantAttachments, 1)
+    local := filepath.Join(os.TempDir(), fmt.Sprintf("pnpi-wpa-%d-%d", os.Getpid(), seq))
+    os.Remove(local)
+
+    conn, err := net.DialUnix("unixgram",
+                        &net.UnixAddr{Name: local, Net: "unixgram"},
+                        &net.UnixAddr{Name: filepath.Join(wpaControlDirectory, iface), Net: "unixgram"})
+    if err != nil {
+        return nil, err
+    }
+    os.Remove(local)  // still bound, no longer needs a name
+
+    if _, err = conn.Write([]byte("ATTACH")); err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    buf := make([]byte, 16)
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    n, err := conn.Read(buf)
+    if err != nil || strings.TrimSpace(string(buf[:n])) != "OK" {
+        conn.Close()
+        return nil, fmt.Errorf("ATTACH refused")
+    }
+    return conn, nil
+}
+
+// Listen to wpa_supplicant's control interface for connection events.
+// Re-attaches if wpa_supplicant goes away and comes back.
+func WatchSupplicant(events chan<- bool, done <-chan struct{}) {
+    buf := make([]byte, 4096)
+
+    for !isDone(done) {
+        iface, err := DefaultWlanInterface()
+        var conn *net.UnixConn
+        if err == nil && iface != "" {
+            conn, err = attachSupplicant(iface)
+        }
+        if conn == nil {
+            LogDebug("Cannot attach to wpa_supplicant, retry later:", err)
+            for i := 0; i < 10 && !isDone(done); i++ {
+                time.Sleep(1 * time.Second)
+            }
+            continue
+        }
+
+        for !isDone(done) {
+            conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+            n, err := conn.Read(buf)
+            if e, ok := err.(net.Error); ok && e.Timeout() {
+                continue
+            }
+            if err != nil {
+                break
+            }
+
+            msg := string(buf[:n])
+            for _,e := range wpaEvents {
+                if strings.Contains(msg, e) {
+                    signalEvent(events)
+                    break
+                }
+            }
+            if strings.Contains(msg, "CTRL-EVENT-TERMINATING") {
+                break
+            }
+        }
+
+        conn.Write([]byte("DETACH"))
+        conn.Close()
+    }
+}
+
+// wpa_supplicant disables a network for a while after failing to connect, and
+// says why, e.g.
+// CTRL-EVENT-SSID-TEMP-DISABLED id=0 ssid="home" auth_failures=1 duration=10 reason=WRONG_KEY
+func isWrongKey(msg string, ssid string, ids []string) bool {
+    if !strings.Contains(msg, "CTRL-EVENT-SSID-TEMP-DISABLED") || !strings.Contains(msg, "reason=WRONG_KEY") {
+        return false
+    }
+    if strings.Contains(msg, " ssid=\"" + ssid + "\" ") {
+        return true
+    }
+    // SSID may be escaped, but the network id is not.
+    for _,id := range ids {
+        if strings.Contains(msg, " id=" + id + " ") {
+            return true
+        }
+    }
+    return false
+}
+
+// Returned channel is closed when wpa_supplicant rejects the key for ssid.
+// Watching stops when done is closed.
+func WatchWrongKey(ssid string, done <-chan struct{}) (<-chan struct{}, error) {
+    iface, err := DefaultWlanInterface()
+    if err != nil {
+        return nil, err
+    }
+    if iface == "" {
+        return nil, fmt.Errorf("No wireless interface")
+    }
+    conn, err := attachSupplicant(iface)
+    if err != nil {
+        return nil, err
+    }
+
+    var ids []string
+    networks,_ := SavedWifiNetworks()
+    for _,n := range networks {
+        if n.SSID == ssid {
+            ids = append(ids, n.ID)
+        }
+    }
+
+    wrongKey := make(chan struct{})
+    go func() {
+        defer conn.Close()
+        defer conn.Write([]byte("DETACH"))
+
+        buf := make([]byte, 4096)
+        for !isDone(done) {
+            conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+            n, err := conn.Read(buf)
+            if e, ok := err.(net.Error); ok && e.Timeout() {
+                continue
+            }
+            if err != nil {
+                return
+            }
+            if isWrongKey(string(buf[:n]), ssid, ids) {
+                close(wrongKey)
+                return
+            }
+        }
+    }()
+    return wrongKey, nil
+}
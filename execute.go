@@ -2,11 +2,16 @@ package main
 
 import (
     "fmt"
+    "strings"
+    "time"
 )
 
+// An executor may send several results for one command. Those before the
+// last only carry a Report, to be relayed to the client.
 type CommandResult struct {
     Cmd *Command
     Err error
+    Report interface{}
 }
 
 func ExecuteCommands(in <-chan *Command, out chan<- *CommandResult, notify chan<- int, id int) {
@@ -22,24 +27,132 @@ func ExecuteCommands(in <-chan *Command, out chan<- *CommandResult, notify chan<
 
     for cmd := range in {
         var e error
+        report := func(r interface{}) {
+            out <- &CommandResult{cmd, nil, r}
+        }
+
         switch cmd.Action {
         case "country": e = SetWifiCountry(cmd.Args[0])
-        case "connect": e = WifiConnect(cmd.Args[0], cmd.Args[1])
+        case "connect":
+            e = connectAndFollow(cmd.Action, cmd.Args[0], func() error {
+                return WifiConnect(cmd.Args[0], cmd.Args[1], cmd.Arg(2) == "hidden")
+            }, report)
+        case "wps": e = WifiWps(cmd.Arg(0), report)
+        case "connect_enterprise":
+            e = connectAndFollow(cmd.Action, cmd.Args[0], func() error {
+                return WifiConnectEnterprise(&EnterpriseCredentials{
+                        SSID: cmd.Args[0],
+                        Method: strings.ToUpper(cmd.Args[1]),
+                        Identity: cmd.Args[2],
+                        AnonymousIdentity: cmd.Arg(3),
+                        Password: cmd.Arg(4),
+                        Phase2: strings.ToUpper(cmd.Arg(5)),
+                        CACert: cmd.Arg(6),
+                        DomainMatch: cmd.Arg(7)})
+            }, report)
         case "disconnect": e = WifiDisconnect(cmd.Args[0])
-        case "start": e = StartService(cmd.Args[0])
-        case "stop": e = StopService(cmd.Args[0])
+        case "saved":
+            report(savedNetworksReport())
+        case "forget":
+            e = WifiForget(cmd.Args[0])
+            report(savedNetworksReport())
+        case "priority":
+            e = WifiSetPriority(cmd.Args[0], cmd.Args[1])
+            report(savedNetworksReport())
+        case "autoconnect":
+            e = WifiSetAutoconnect(cmd.Args[0], cmd.Args[1] == "on")
+            report(savedNetworksReport())
+        case "switch":
+            e = WifiSwitch(cmd.Args[0], report)
+            report(savedNetworksReport())
+        case "dhcp": e = SetInterfaceDhcp(cmd.Args[0])
+        case "static":
+            var dns []string
+            if len(cmd.Args) > 3 {
+                dns = cmd.Args[3:]
+            }
+            e = SetInterfaceStatic(cmd.Args[0], cmd.Args[1], cmd.Arg(2), dns)
+        case "hostname": e = SetHostname(cmd.Args[0])
+        case "time": e = SetSystemTime(cmd.Args[0], cmd.Arg(1))
+        case "start":
+            var d time.Duration
+            if cmd.Arg(1) != "" {
+                d, e = time.ParseDuration(cmd.Arg(1))
+                if e == nil && d <= 0 {
+                    e = fmt.Errorf("Duration must be positive: %v", cmd.Arg(1))
+                }
+            }
+            if e != nil {
+                break
+            }
+            if e = checkServicePolicy(cmd.Args[0]); e != nil {
+                report(RetrieveSecurity())
+                break
+            }
+            if e = StartService(cmd.Args[0]); e == nil {
+                if d > 0 {
+                    SetServiceDeadline(cmd.Args[0], d)
+                } else {
+                    ClearServiceDeadline(cmd.Args[0])
+                }
+            }
+        case "passwd":
+            e = SetPassword(cmd.Args[0], cmd.Args[1])
+            report(RetrieveSecurity())
+        case "require_new_password":
+            e = SetClientRequireNewPassword(cmd.Args[0] == "on")
+            report(RetrieveSecurity())
+        case "ssh_keys":
+            report(sshKeysReport(cmd.Args[0]))
+        case "ssh_key_add":
+            e = AddSshKeys(cmd.Args[0], cmd.Args[1:])
+            report(sshKeysReport(cmd.Args[0]))
+        case "ssh_key_remove":
+            e = RemoveSshKey(cmd.Args[0], cmd.Args[1])
+            report(sshKeysReport(cmd.Args[0]))
+        case "ssh_password_auth":
+            e = SetSshPasswordAuthentication(cmd.Args[0] == "on")
+            report(RetrieveSecurity())
+        case "stop":
+            if e = StopService(cmd.Args[0]); e == nil {
+                ClearServiceDeadline(cmd.Args[0])
+            }
+        case "hardware":
+            report(RetrieveHardware())
+        case "hardware_set":
+            e = SetHardwareInterface(cmd.Args[0], cmd.Args[1] == "on")
+            report(RetrieveHardware())
+        case "config_read":
+            report(RetrieveBootConfig())
+        case "config_set":
+            e = SetBootConfig(cmd.Args[0], cmd.Args[1], cmd.Args[2])
+            report(RetrieveBootConfig())
+        case "config_remove":
+            e = RemoveBootConfig(cmd.Args[0], cmd.Args[1], cmd.Arg(2))
+            report(RetrieveBootConfig())
+        case "config_revert":
+            e = RevertBootConfig()
+            report(RetrieveBootConfig())
         case "halt": e = HaltSystem()
         case "reboot": e = RebootSystem()
         default: panic(fmt.Sprintf("Invalid command: %v", cmd))
         }
-        out <- &CommandResult{cmd, e}
+        out <- &CommandResult{cmd, e, nil}
     }
 }
 
 func CommandIsChangingSystemStates(cmd *Command) bool {
     return (cmd.Action == "country" ||
             cmd.Action == "connect" ||
+            cmd.Action == "connect_enterprise" ||
+            cmd.Action == "wps" ||
             cmd.Action == "disconnect" ||
+            cmd.Action == "forget" ||
+            cmd.Action == "autoconnect" ||
+            cmd.Action == "switch" ||
+            cmd.Action == "dhcp" ||
+            cmd.Action == "static" ||
+            cmd.Action == "hostname" ||
             cmd.Action == "start" ||
             cmd.Action == "stop")
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+    "html/template"
+    "net/http"
+    "os"
+    "sync"
+    "time"
+)
+
+// How long without connectivity before the access point comes up. 0 disables.
+var fallbackDelay time.Duration
+var fallbackPassphrase string
+
+func SetFallbackAp(d time.Duration, passphrase string) {
+    fallbackDelay = d
+    fallbackPassphrase = passphrase
+}
+
+const fallbackAddress = "192.168.4.1"
+
+var fallback struct {
+    sync.Mutex
+    phone bool
+    iface string               // non-empty while access point is up
+    connecting chan struct{}   // non-nil while setup page connects, closed when done
+    hotspots []Hotspot         // scanned before access point comes up
+    server *http.Server
+}
+
+func fallbackSsid() string {
+    name, err := os.Hostname()
+    if err != nil || name == "" {
+        name = "raspberrypi"
+    }
+    return "pnpi-" + name
+}
+
+// Lock must not be held. Scanning takes a while, so the lock is only taken
+// after it, and the phone may have attached by then.
+func startAp() {
+    wlan, err := DefaultWlanInterface()
+    if err != nil || wlan == "" {
+        LogDebug("No wireless interface for access point")
+        return
+    }
+
+    // The radio cannot scan once it is an access point.
+    r := scanForResult(false)
+
+    fallback.Lock()
+    defer fallback.Unlock()
+
+    if fallback.phone || fallback.connecting != nil || fallback.iface != "" {
+        return
+    }
+    if r != nil {
+        fallback.hotspots = r.Hotspots
+    }
+
+    LogInfo("No connectivity, bringing up access point", fallbackSsid())
+    if _, err := raspi_config("do_ap_start", wlan, fallbackSsid(), fallbackPassphrase); err != nil {
+        LogInfo("Cannot bring up access point:", err)
+        raspi_config("do_ap_stop", wlan)
+        return
+    }
+    fallback.iface = wlan
+
+    fallback.server = &http.Server{Addr: fallbackAddress + ":80", Handler: http.HandlerFunc(serveSetupPage)}
+    go func(s *http.Server) {
+        if err := s.ListenAndServe(); err != http.ErrServerClosed {
+            LogInfo("Setup page stops:", err)
+        }
+    }(fallback.server)
+}
+
+// Lock must be held
+func stopAp() {
+    if fallback.iface == "" {
+        return
+    }
+
+    LogInfo("Taking down access point")
+    fallback.server.Close()
+    if _, err := raspi_config("do_ap_stop", fallback.iface); err != nil {
+        LogInfo("Cannot take down access point:", err)
+    }
+    fallback.iface = ""
+}
+
+// The phone needs the radio to scan and connect, so it takes over. A setup
+// page connect is cancelled, and waited for, so it is not mixed up with one
+// from the phone.
+func SetPhoneAttached(b bool) {
+    fallback.Lock()
+    fallback.phone = b
+    if b {
+        stopAp()
+    }
+    connecting := fallback.connecting
+    fallback.Unlock()
+
+    if !b || connecting == nil {
+        return
+    }
+
+    LogInfo("Phone attached, cancelling setup page connect")
+    for {
+        // Again, in case it came before the connect began
+        CancelWifi()
+        select {
+        case <-connecting:
+            return
+        case <-time.After(1 * time.Second):
+        }
+    }
+}
+
+// Runs for the life of the process
+func FallbackAp() {
+    if fallbackDelay == 0 {
+        return
+    }
+
+    offline := time.Now()
+    for {
+        time.Sleep(10 * time.Second)
+
+        fallback.Lock()
+        idle := fallback.phone || fallback.connecting != nil || fallback.iface != ""
+        fallback.Unlock()
+
+        if idle || len(DefaultRoutes()) > 0 {
+            offline = time.Now()
+        } else if time.Since(offline) >= fallbackDelay {
+            startAp()
+            offline = time.Now()
+        }
+    }
+}
+
+// The access point must be down for wpa_supplicant to connect. If it fails,
+// the access point comes back. The lock is not held while connecting, so a
+// phone attaching can cancel it.
+func connectFromSetupPage(ssid string, passphrase string, hidden bool) {
+    // Let the response reach the client first
+    time.Sleep(2 * time.Second)
+
+    fallback.Lock()
+    if fallback.phone || fallback.iface == "" || fallback.connecting != nil {
+        fallback.Unlock()
+        return
+    }
+    connecting := make(chan struct{})
+    fallback.connecting = connecting
+    stopAp()
+    fallback.Unlock()
+
+    err := connectAndFollow("connect", ssid, func() error {
+        return WifiConnect(ssid, passphrase, hidden)
+    }, func(r interface{}) {
+        LogDebugf("Setup page connect: %+v", r)
+    })
+
+    fallback.Lock()
+    fallback.connecting = nil
+    fallback.Unlock()
+    close(connecting)
+
+    if err != nil {
+        startAp()
+    }
+}
+
+var setupPage = template.Must(template.New("setup").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Plug n Pi Setup</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+li { margin: 0.5em 0; }
+input { font-size: 1em; margin: 0.2em 0; }
+</style>
+</head>
+<body>
+{{if .Connecting}}
+<h1>Connecting to {{.Connecting}}</h1>
+<p>This setup network is going away. If the Pi cannot connect, it comes back
+in a minute.</p>
+{{else}}
+<h1>Connect {{.Name}} to WiFi</h1>
+<ul>
+{{range .Hotspots}}
+<li>
+<form method="post" action="/connect">
+<input type="hidden" name="ssid" value="{{.SSID}}">
+<b>{{.SSID}}</b> {{.Security}} {{.Signal}} dBm{{if .Saved}}, saved{{end}}<br>
+{{if not .Open}}<input type="password" name="passphrase" placeholder="Password">{{end}}
+<input type="submit" value="Connect">
+</form>
+</li>
+{{else}}
+<li>No networks found</li>
+{{end}}
+</ul>
+<h2>Hidden network</h2>
+<form method="post" action="/connect">
+<input type="text" name="ssid" placeholder="Network name"><br>
+<input type="password" name="passphrase" placeholder="Password"><br>
+<input type="hidden" name="hidden" value="1">
+<input type="submit" value="Connect">
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type setupPageData struct {
+    Name string
+    Hotspots []Hotspot
+    Connecting string
+}
+
+// Every path gets the page, so phones detect a captive portal and open it.
+func serveSetupPage(w http.ResponseWriter, r *http.Request) {
+    fallback.Lock()
+    data := setupPageData{Name: fallbackSsid(), Hotspots: fallback.hotspots}
+    fallback.Unlock()
+
+    if r.Method == "POST" && r.URL.Path == "/connect" {
+        ssid := r.PostFormValue("ssid")
+        if !ssidIsValid(ssid) {
+            http.Redirect(w, r, "/", http.StatusSeeOther)
+            return
+        }
+        data.Connecting = ssid
+        go connectFromSetupPage(ssid, r.PostFormValue("passphrase"), r.PostFormValue("hidden") == "1")
+    }
+
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    w.Header().Set("Cache-Control", "no-store")
+    if err := setupPage.Execute(w, data); err != nil {
+        LogDebug("Cannot render setup page:", err)
+    }
+}
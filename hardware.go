@@ -0,0 +1,102 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+type hardwareFunctions struct {
+    name string
+    doer, getter string
+    reboot bool   // takes effect only after reboot
+}
+
+// I2C and SPI are applied at once by dtparam. The rest need a reboot.
+var hardwareInterfaces = []hardwareFunctions{
+    {"i2c", "do_i2c", "get_i2c", false},
+    {"spi", "do_spi", "get_spi", false},
+    {"serial", "do_serial", "get_serial", true},
+    {"serial_console", "do_serial_console", "get_serial_console", true},
+    {"camera", "do_camera", "get_camera", true},
+    {"onewire", "do_onewire", "get_onewire", true},
+}
+
+func findHardwareInterface(name string) (*hardwareFunctions, error) {
+    for i := range hardwareInterfaces {
+        if hardwareInterfaces[i].name == name {
+            return &hardwareInterfaces[i], nil
+        }
+    }
+    return nil, fmt.Errorf("Invalid hardware interface: %v", name)
+}
+
+func (h *hardwareFunctions) enabled() (bool, error) {
+    status, err := raspi_config(h.getter)
+    if err != nil {
+        return false, err
+    }
+    return (strings.TrimSpace(status) == "0"), err
+}
+
+// Under /run, so it is cleared by the reboot itself
+const rebootRequiredPath = "/run/pnpi/reboot-required"
+
+func MarkRebootRequired() {
+    if err := os.MkdirAll(filepath.Dir(rebootRequiredPath), 0755); err != nil {
+        LogDebug("Cannot mark reboot required:", err)
+        return
+    }
+    if err := ioutil.WriteFile(rebootRequiredPath, nil, 0644); err != nil {
+        LogDebug("Cannot mark reboot required:", err)
+    }
+}
+
+func RebootRequired() bool {
+    if _, err := os.Stat(rebootRequiredPath); err == nil {
+        return true
+    }
+    return bootConfigChanged()
+}
+
+func RetrieveHardware() *HardwareReport {
+    r := NewHardwareReport()
+    for i := range hardwareInterfaces {
+        h := &hardwareInterfaces[i]
+        on, err := h.enabled()
+        if err != nil {
+            LogDebug("Cannot obtain", h.name, "status:", err)
+            continue
+        }
+        r.Interfaces = append(r.Interfaces, HardwareInterface{h.name, on})
+    }
+    r.RebootRequired = RebootRequired()
+    return r
+}
+
+func SetHardwareInterface(name string, on bool) error {
+    h, err := findHardwareInterface(name)
+    if err != nil {
+        return err
+    }
+
+    was, err := h.enabled()
+    if err != nil {
+        return err
+    }
+
+    code := "1"
+    if on {
+        code = "0"
+    }
+    if _, err := raspi_config(h.doer, code); err != nil {
+        return err
+    }
+
+    if h.reboot && was != on {
+        MarkRebootRequired()
+    }
+    return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+    "fmt"
+    "os/exec"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Bits of the firmware's throttled state. Those since boot are the same,
+// shifted left by 16.
+const (
+    throttleUnderVoltage = 1 << 0
+    throttleFrequencyCapped = 1 << 1
+    throttleThrottled = 1 << 2
+    throttleSoftTempLimit = 1 << 3
+)
+
+func throttleFlags(bits uint64) Throttle {
+    return Throttle{
+        bits & throttleUnderVoltage != 0,
+        bits & throttleFrequencyCapped != 0,
+        bits & throttleThrottled != 0,
+        bits & throttleSoftTempLimit != 0,
+    }
+}
+
+// Firmware exposes throttled state in sysfs on newer kernels. Otherwise, ask
+// vcgencmd, which prints "throttled=0x50005".
+func readThrottled() (uint64, error) {
+    s, err := readSysFile("/sys/devices/platform/soc/soc:firmware/get_throttled")
+    if err == nil {
+        return strconv.ParseUint(s, 16, 32)
+    }
+
+    out, err := exec.Command("vcgencmd", "get_throttled").Output()
+    if err != nil {
+        return 0, err
+    }
+
+    kv := strings.SplitN(strings.TrimSpace(string(out)), "=", 2)
+    if len(kv) != 2 {
+        return 0, fmt.Errorf("Unexpected vcgencmd output: %s", out)
+    }
+    return strconv.ParseUint(strings.TrimPrefix(kv[1], "0x"), 16, 32)
+}
+
+func inspectHealth() *HealthReport {
+    h := &HealthReport{Type: "health"}
+
+    if t, err := readSysFile("/sys/class/thermal/thermal_zone0/temp"); err == nil {
+        milli,_ := strconv.Atoi(t)
+        h.Temperature = float64(milli) / 1000
+    } else {
+        LogDebug("Cannot read temperature:", err)
+    }
+
+    if f, err := readSysFile("/sys/devices/system/cpu/cpu0/cpufreq/scaling_cur_freq"); err == nil {
+        khz,_ := strconv.Atoi(f)
+        h.CpuFrequency = khz / 1000
+    } else {
+        LogDebug("Cannot read CPU frequency:", err)
+    }
+
+    if bits, err := readThrottled(); err == nil {
+        h.Now, h.SinceBoot = throttleFlags(bits), throttleFlags(bits >> 16)
+    } else {
+        LogDebug("Cannot read throttled state:", err)
+    }
+    return h
+}
+
+const (
+    HealthStart = 1 << iota
+    HealthStop
+)
+
+func MonitorHealth(in <-chan int, out chan<- interface{}, notify chan<- int, id int) {
+    defer RecoverDo(
+        func(x interface{}) {
+            notify <- id
+            LogDebug("Health monitor terminates due to:", x)
+        },
+        func() {
+            LogDebug("Health monitor terminates normally")
+        },
+    )
+
+    // Sample often, so under-voltage is caught quickly. Report less often,
+    // unless throttled state changes.
+    ticker := time.NewTicker(2 * time.Second)
+    defer ticker.Stop()
+    const reportEvery = 5
+
+    active := false
+    ticks := 0
+    var last *HealthReport
+
+    sample := func() {
+        h := inspectHealth()
+        if h.Now.UnderVoltage && (last == nil || !last.Now.UnderVoltage) {
+            out <- NewAlert(AlertUnderVoltage, "Under-voltage detected. Use a better power supply and cable.")
+        }
+
+        if last == nil || ticks % reportEvery == 0 || h.Now != last.Now || h.SinceBoot != last.SinceBoot {
+            out <- h
+        }
+        last = h
+        ticks++
+    }
+
+    for {
+        select {
+        case ctrl, ok := <-in:
+            if !ok { return }
+
+            switch ctrl {
+            case HealthStart:
+                active, ticks, last = true, 0, nil
+                sample()
+            case HealthStop:
+                active = false
+            default:
+                panic(fmt.Sprintf("Invalid health control code: %v", ctrl))
+            }
+        case <-ticker.C:
+            if active {
+                sample()
+            }
+        }
+    }
+}
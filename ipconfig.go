@@ -0,0 +1,78 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "strings"
+)
+
+func validateInterface(name string) error {
+    if name == "lo" {
+        return fmt.Errorf("Cannot configure loopback interface")
+    }
+    if _, err := net.InterfaceByName(name); err != nil {
+        return fmt.Errorf("No such interface: %v", name)
+    }
+    return nil
+}
+
+func SetInterfaceDhcp(name string) error {
+    if err := validateInterface(name); err != nil {
+        return err
+    }
+    _, err := raspi_config("do_ip_dhcp", name)
+    return err
+}
+
+// address is in CIDR notation, e.g. 192.168.1.20/24. Gateway and DNS servers
+// are optional.
+func SetInterfaceStatic(name string, address string, gateway string, dns []string) error {
+    if err := validateInterface(name); err != nil {
+        return err
+    }
+
+    ip, subnet, err := net.ParseCIDR(address)
+    if err != nil || ip.To4() == nil {
+        return fmt.Errorf("Invalid IPv4 address/prefix: %v", address)
+    }
+
+    if ones, bits := subnet.Mask.Size(); ones < bits - 1 {
+        if ip.Equal(subnet.IP) {
+            return fmt.Errorf("%v is a network address", address)
+        }
+        if ip.Equal(broadcastOf(subnet)) {
+            return fmt.Errorf("%v is a broadcast address", address)
+        }
+    }
+
+    if gateway != "" {
+        gw := net.ParseIP(gateway)
+        if gw == nil || gw.To4() == nil {
+            return fmt.Errorf("Invalid gateway: %v", gateway)
+        }
+        if !subnet.Contains(gw) {
+            return fmt.Errorf("Gateway %v not in %v", gateway, subnet)
+        }
+        if gw.Equal(ip) {
+            return fmt.Errorf("Gateway cannot be the interface's own address")
+        }
+    }
+
+    for _,d := range dns {
+        if net.ParseIP(d) == nil {
+            return fmt.Errorf("Invalid DNS server: %v", d)
+        }
+    }
+
+    _, err = raspi_config("do_ip_static", name, address, gateway, strings.Join(dns, " "))
+    return err
+}
+
+func broadcastOf(n *net.IPNet) net.IP {
+    ip := n.IP.To4()
+    b := make(net.IP, len(ip))
+    for i := range ip {
+        b[i] = ip[i] | ^n.Mask[len(n.Mask) - len(ip) + i]
+    }
+    return b
+}
@@ -4,6 +4,9 @@ import (
     "fmt"
     "strings"
     "net"
+    "os"
+    "sort"
+    "strconv"
     "time"
 )
 
@@ -14,6 +17,11 @@ type SystemInfo struct {
     Interfaces NetworkInterfaceMap
     Services ServiceMap
     WifiCountryCode string
+    Routes []Route
+    DnsServers []string
+    Reachability *Reachability
+    Hostname string
+    NtpSynchronized bool
 }
 
 type MonitorReport struct {
@@ -21,6 +29,11 @@ type MonitorReport struct {
     Interfaces []NetworkInterface
     Services []Service
     WifiCountryCode string
+    Routes []Route
+    DnsServers []string
+    Reachability *Reachability
+    Hostname string
+    NtpSynchronized bool
 }
 
 func (m NetworkInterfaceMap) Keys() *StringSet {
@@ -57,6 +70,59 @@ func (m ServiceMap) Values() []Service {
     return ss
 }
 
+func scopeOf(ip net.IP) string {
+    switch {
+    case ip.IsLoopback():
+        return ScopeHost
+    case ip.IsLinkLocalUnicast():
+        return ScopeLink
+    default:
+        return ScopeGlobal
+    }
+}
+
+func addressOf(ipnet *net.IPNet) Address {
+    prefix,_ := ipnet.Mask.Size()
+    family := FamilyIPv6
+    if ipnet.IP.To4() != nil {
+        family = FamilyIPv4
+    }
+    return Address{ipnet.IP.String(), prefix, family, scopeOf(ipnet.IP)}
+}
+
+// IPv4 before IPv6, global before link-local
+type byAddress []Address
+
+func (as byAddress) Len() int { return len(as) }
+func (as byAddress) Swap(i, j int) { as[i], as[j] = as[j], as[i] }
+func (as byAddress) Less(i, j int) bool {
+    a, b := as[i], as[j]
+    switch {
+    case a.Family != b.Family: return a.Family < b.Family
+    case a.Scope != b.Scope: return a.Scope < b.Scope
+    default: return a.IP < b.IP
+    }
+}
+
+// Link state from sysfs. Carrier and speed cannot be read while interface is
+// down, and speed is unknown (-1) for WiFi.
+func readLinkState(name string) (operstate string, carrier bool, speed int) {
+    dir := "/sys/class/net/" + name + "/"
+
+    operstate,_ = readSysFile(dir + "operstate")
+
+    if c, err := readSysFile(dir + "carrier"); err == nil {
+        carrier = c == "1"
+    }
+
+    if s, err := readSysFile(dir + "speed"); err == nil {
+        if n, err := strconv.Atoi(s); err == nil && n > 0 {
+            speed = n
+        }
+    }
+    return
+}
+
 func gatherInterfaces() NetworkInterfaceMap {
     wlan00, err := DefaultWlanInterface()
     if err != nil {
@@ -77,13 +143,19 @@ func gatherInterfaces() NetworkInterfaceMap {
     for _,i := range ifaces {
         if i.Name == "lo" { continue }
 
-        ps := NewStringSet()
+        operstate, carrier, speed := readLinkState(i.Name)
+        ni := NetworkInterface{
+                    Name: i.Name,
+                    IPs: NewStringSet(),
+                    MAC: i.HardwareAddr.String(),
+                    OperState: operstate,
+                    Carrier: carrier,
+                    Speed: speed,
+                    WiFi: isDefaultWlan(i.Name)}
+
         addrs, err := i.Addrs()
         if err != nil {
-            ifmap[i.Name] = NetworkInterface{
-                                    Name: i.Name,
-                                    IPs: ps,
-                                    WiFi: isDefaultWlan(i.Name)}
+            ifmap[i.Name] = ni
             LogDebugf("Cannot obtain addresses for %v: %v", i.Name, err)
             continue
         }
@@ -91,29 +163,30 @@ func gatherInterfaces() NetworkInterfaceMap {
         for _,a := range addrs {
             switch b := a.(type) {
             case *net.IPNet:
-                ps.Add(b.IP.String())
+                ni.IPs.Add(b.IP.String())
+                ni.Addresses = append(ni.Addresses, addressOf(b))
             case *net.IPAddr:
-                ps.Add(b.IP.String())
+                ni.IPs.Add(b.IP.String())
+                ip := b.IP
+                if v4 := ip.To4(); v4 != nil {
+                    ip = v4
+                }
+                bits := 8 * len(ip)
+                ni.Addresses = append(ni.Addresses,
+                                addressOf(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}))
             }
         }
+        sort.Sort(byAddress(ni.Addresses))
 
-        if strings.HasPrefix(i.Name, "wlan") && ps.Size() > 0 {
+        if strings.HasPrefix(i.Name, "wlan") && ni.IPs.Size() > 0 {
             ssid, err := ReportSsid(i.Name)
             if err != nil {
                 LogDebug("Cannot obtain SSID:", err)
             }
-
-            ifmap[i.Name] = NetworkInterface{
-                                    Name: i.Name,
-                                    IPs: ps,
-                                    SSID: ssid,
-                                    WiFi: isDefaultWlan(i.Name)}
-        } else {
-            ifmap[i.Name] = NetworkInterface{
-                                    Name: i.Name,
-                                    IPs: ps,
-                                    WiFi: isDefaultWlan(i.Name)}
+            ni.SSID = ssid
         }
+
+        ifmap[i.Name] = ni
     }
     return ifmap
 }
@@ -121,9 +194,13 @@ func gatherInterfaces() NetworkInterfaceMap {
 func gatherServices() ServiceMap {
     ssh,_ := ServiceIsRunning("SSH")
     vnc,_ := ServiceIsRunning("VNC")
+    var hostKeys []SshKey
+    if ssh {
+        hostKeys = SshHostKeys()
+    }
     return ServiceMap{
-        "SSH": Service{"SSH", ssh},
-        "VNC": Service{"VNC", vnc},
+        "SSH": NewService("SSH", ssh, hostKeys),
+        "VNC": NewService("VNC", vnc, nil),
     }
 }
 
@@ -132,12 +209,40 @@ func getWifiCountryCode() string {
     return c
 }
 
-func inspectSystem() *SystemInfo {
-    return &SystemInfo { gatherInterfaces(), gatherServices(), getWifiCountryCode() }
+func getHostname() string {
+    h, err := os.Hostname()
+    if err != nil {
+        LogDebug("Cannot obtain hostname:", err)
+    }
+    return h
+}
+
+// Reachability is probed separately, as it takes a while.
+func inspectSystem(reach *Reachability) *SystemInfo {
+    return &SystemInfo {
+        gatherInterfaces(),
+        gatherServices(),
+        getWifiCountryCode(),
+        DefaultRoutes(),
+        DnsServers(),
+        reach,
+        getHostname(),
+        NtpSynchronized(),
+    }
 }
 
 func produceFullReport(s *SystemInfo) *MonitorReport {
-    return &MonitorReport { true, s.Interfaces.Values(), s.Services.Values(), s.WifiCountryCode }
+    return &MonitorReport {
+        true,
+        s.Interfaces.Values(),
+        s.Services.Values(),
+        s.WifiCountryCode,
+        s.Routes,
+        s.DnsServers,
+        s.Reachability,
+        s.Hostname,
+        s.NtpSynchronized,
+    }
 }
 
 func produceReport(new *SystemInfo, old *SystemInfo) *MonitorReport {
@@ -155,15 +260,31 @@ func produceReport(new *SystemInfo, old *SystemInfo) *MonitorReport {
 
     var servs []Service
     for name, s := range new.Services {
-        if s != old.Services[name] {
+        if !s.Equal(old.Services[name]) {
             servs = append(servs, s)
         }
     }
 
-    if ifaces == nil && servs == nil && new.WifiCountryCode == old.WifiCountryCode {
+    if ifaces == nil && servs == nil &&
+            new.WifiCountryCode == old.WifiCountryCode &&
+            routesEqual(new.Routes, old.Routes) &&
+            stringsEqual(new.DnsServers, old.DnsServers) &&
+            *new.Reachability == *old.Reachability &&
+            new.Hostname == old.Hostname &&
+            new.NtpSynchronized == old.NtpSynchronized {
         return nil
     } else {
-        return &MonitorReport { false, ifaces, servs, new.WifiCountryCode }
+        return &MonitorReport {
+            false,
+            ifaces,
+            servs,
+            new.WifiCountryCode,
+            new.Routes,
+            new.DnsServers,
+            new.Reachability,
+            new.Hostname,
+            new.NtpSynchronized,
+        }
     }
 }
 
@@ -186,6 +307,29 @@ func MonitorSystem(in <-chan int, out chan<- *MonitorReport, notify chan<- int,
 
     var current *SystemInfo
 
+    // Reachability probe runs in background. Its result is folded into
+    // subsequent inspections.
+    reachability := &Reachability{ReachabilityUnknown, ""}
+    probeResults := make(chan *Reachability, 1)
+    probing := false
+    probe := func() {
+        if !probing {
+            probing = true
+            go func() { probeResults <- ProbeReachability() }()
+        }
+    }
+
+    // Probe again whenever routes change
+    var inspected time.Time
+    inspect := func() *SystemInfo {
+        inspected = time.Now()
+        s := inspectSystem(reachability)
+        if current != nil && !routesEqual(s.Routes, current.Routes) {
+            probe()
+        }
+        return s
+    }
+
     // Wait for first control code ...
     ctrl, ok := <-in
     if !ok {
@@ -195,18 +339,34 @@ func MonitorSystem(in <-chan int, out chan<- *MonitorReport, notify chan<- int,
     // ... which must be MonitorStart
     switch ctrl {
     case MonitorStart:
-        s := inspectSystem()
+        s := inspect()
         r := produceFullReport(s)
 
         current = s
         out <- r
+        probe()
     default:
         panic(fmt.Sprintf("Invalid first control code: %v", ctrl))
     }
 
-    // Regular report interval = 3 sec
+    // Changes are pushed by kernel and wpa_supplicant. Polling is only a
+    // safety net, unless subscription fails.
+    events := make(chan bool, 1)
+    done := make(chan struct{})
+    defer close(done)
+
+    netlinkLost := WatchNetlink(events, done)
+    eventDriven := true
+    go WatchSupplicant(events, done)
+
+    // Events come in bunches. Let them settle before inspecting.
+    var settle <-chan time.Time
+
+    // Regular report interval = 3 sec. If event-driven, it is mostly an empty
+    // object to show I am alive, and a full inspection every 30 sec.
     regularTicker := time.NewTicker(3 * time.Second)
     defer regularTicker.Stop()
+    const safetyInterval = 30 * time.Second
     active := true
 
     // Report more frequently on receiving MonitorBurst
@@ -214,6 +374,9 @@ func MonitorSystem(in <-chan int, out chan<- *MonitorReport, notify chan<- int,
     defer burstTicker.Stop()
     bursts := 0
 
+    probeTicker := time.NewTicker(probeInterval)
+    defer probeTicker.Stop()
+
     for {
         select {
         case ctrl, ok = <-in:
@@ -222,11 +385,12 @@ func MonitorSystem(in <-chan int, out chan<- *MonitorReport, notify chan<- int,
             switch ctrl {
             case MonitorStart:
                 active = true
-                s := inspectSystem()
+                s := inspect()
                 r := produceFullReport(s)
 
                 current = s
                 out <- r
+                probe()
 
             case MonitorBurst:
                 bursts = 9
@@ -240,22 +404,68 @@ func MonitorSystem(in <-chan int, out chan<- *MonitorReport, notify chan<- int,
             }
         case <-regularTicker.C:
             if active {
-                s := inspectSystem()
+                if eventDriven && time.Since(inspected) < safetyInterval {
+                    out <- nil
+                    continue
+                }
+
+                s := inspect()
                 r := produceReport(s, current)
 
                 current = s
                 out <- r
             }
 
+        // Back to polling every 3 sec
+        case <-netlinkLost:
+            netlinkLost = nil
+            eventDriven = false
+
+        case <-events:
+            if active && settle == nil {
+                settle = time.After(300 * time.Millisecond)
+            }
+
+        case <-settle:
+            settle = nil
+            if active {
+                s := inspect()
+                r := produceReport(s, current)
+
+                // Not a regular report. Skip if nothing changed.
+                current = s
+                if r != nil {
+                    out <- r
+                }
+            }
+
         case <-burstTicker.C:
             if active && bursts > 0 {
                 bursts--
-                s := inspectSystem()
+                s := inspect()
                 r := produceReport(s, current)
 
                 current = s
                 out <- r
             }
+
+        case <-probeTicker.C:
+            if active {
+                probe()
+            }
+
+        case reachability = <-probeResults:
+            probing = false
+            if active {
+                s := inspect()
+                r := produceReport(s, current)
+
+                // Not a regular report. Skip if nothing changed.
+                current = s
+                if r != nil {
+                    out <- r
+                }
+            }
         }
     }
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+    "bufio"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "io"
+)
+
+// Since protocol version 3, every message on the accessory stream, in both
+// directions, is a frame:
+// channel (2 bytes), flags (1 byte), payload length (2 bytes), payload.
+// Channel 0 carries JSON commands and objects, one per frame.
+const (
+    ControlChannel = 0
+
+    frameHeaderSize = 5
+    maxFramePayload = 32767   // Java short's max value
+)
+
+const (
+    FrameOpen = 1 << iota     // payload names the target, e.g. "tcp:22". Echoed to accept.
+    FrameClose                // no more data from sender
+    FrameReset                // abort, payload is the reason
+    FrameWindow               // payload is a 4-byte credit increment
+)
+
+// Version 2 clients send bare JSON commands, and take objects with a 2-byte
+// length before each. They have no channels.
+const (
+    ProtocolUnframed = 2
+    ProtocolFramed = 3
+)
+
+// Nothing is written before the client's first command. A framed one begins
+// with the high byte of channel 0, a bare JSON one with '{' or whitespace.
+func DetectProtocolVersion(r *bufio.Reader) (int, error) {
+    b, err := r.Peek(1)
+    if err != nil {
+        return 0, err
+    }
+    if b[0] == 0 {
+        return ProtocolFramed, nil
+    }
+    return ProtocolUnframed, nil
+}
+
+// Bytes either end may send on a channel before it is granted more by WINDOW
+const initialWindow = 65536
+
+type Frame struct {
+    Channel uint16
+    Flags uint8
+    Payload []byte
+}
+
+func (f *Frame) String() string {
+    return fmt.Sprintf("{%d %#x %d bytes}", f.Channel, f.Flags, len(f.Payload))
+}
+
+// A JSON object for the control channel, written in order with data frames
+func NewControlFrame(obj interface{}) *Frame {
+    body, err := json.Marshal(obj)
+    if err != nil {
+        panic(err)
+    }
+    return &Frame{ControlChannel, 0, body}
+}
+
+func NewWindowFrame(channel uint16, increment int) *Frame {
+    b := make([]byte, 4)
+    binary.BigEndian.PutUint32(b, uint32(increment))
+    return &Frame{channel, FrameWindow, b}
+}
+
+func NewResetFrame(channel uint16, reason error) *Frame {
+    p := []byte(reason.Error())
+    if len(p) > maxFramePayload {
+        p = p[:maxFramePayload]
+    }
+    return &Frame{channel, FrameReset, p}
+}
+
+func ReadFrame(r io.Reader) (*Frame, error) {
+    header := make([]byte, frameHeaderSize)
+    if _, err := io.ReadFull(r, header); err != nil {
+        return nil, err
+    }
+
+    f := &Frame{
+        Channel: binary.BigEndian.Uint16(header[0:2]),
+        Flags: header[2],
+        Payload: make([]byte, binary.BigEndian.Uint16(header[3:5])),
+    }
+    if _, err := io.ReadFull(r, f.Payload); err != nil {
+        return nil, err
+    }
+    return f, nil
+}
+
+// Header and payload in one write, so one USB transfer if it fits
+func WriteFrame(w io.Writer, f *Frame) error {
+    if len(f.Payload) > maxFramePayload {
+        return fmt.Errorf("Frame payload too long: %d bytes", len(f.Payload))
+    }
+
+    b := make([]byte, frameHeaderSize + len(f.Payload))
+    binary.BigEndian.PutUint16(b[0:2], f.Channel)
+    b[2] = f.Flags
+    binary.BigEndian.PutUint16(b[3:5], uint16(len(f.Payload)))
+    copy(b[frameHeaderSize:], f.Payload)
+
+    _, err := w.Write(b)
+    return err
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+    "bufio"
     "fmt"
     "flag"
     "strings"
     "io"
     "os/exec"
     "path/filepath"
+    "time"
     "encoding/json"
     "encoding/binary"
     "github.com/google/gousb"
@@ -16,7 +18,9 @@ func RecoverDo(f func(interface{}), g func()) {
     if r := recover(); r != nil { f(r) } else { g() }
 }
 
-func ReadCommands(r io.Reader, out chan<- *Command) {
+// Commands come on the control channel. Frames of other channels are passed on
+// as they are. Unframed, commands are bare JSON.
+func ReadCommands(r io.Reader, version int, out chan<- *Command, frames chan<- *Frame) {
     defer RecoverDo(
         func(x interface{}) {
             LogDebug("USB Reader terminates due to:", x)
@@ -27,17 +31,39 @@ func ReadCommands(r io.Reader, out chan<- *Command) {
     )
     defer close(out)
 
-    decoder := json.NewDecoder(r)
+    if version == ProtocolUnframed {
+        decoder := json.NewDecoder(r)
+        for {
+            var cmd Command
+            if err := decoder.Decode(&cmd); err != nil {
+                panic(fmt.Sprintf("JSON decoder error: %v", err))
+            }
+            out <- &cmd
+        }
+    }
+
     for {
+        f, err := ReadFrame(r)
+        if err != nil {
+            panic(fmt.Sprintf("Frame reader error: %v", err))
+        }
+
+        if f.Channel != ControlChannel {
+            frames <- f
+            continue
+        }
+
         var cmd Command
-        if err := decoder.Decode(&cmd); err != nil {
+        if err := json.Unmarshal(f.Payload, &cmd); err != nil {
             panic(fmt.Sprintf("JSON decoder error: %v", err))
         }
         out <- &cmd
     }
 }
 
-func WriteReports(ep *gousb.OutEndpoint, in <-chan interface{}, sent chan<- bool, notify chan<- int, id int) {
+// Objects on the control channel go before any data frame waiting, so bulk
+// channels cannot hold up reports.
+func WriteReports(ep *gousb.OutEndpoint, version int, in <-chan interface{}, data <-chan *Frame, sent chan<- bool, notify chan<- int, id int) {
     defer RecoverDo(
         func(x interface{}) {
             notify <- id
@@ -48,7 +74,7 @@ func WriteReports(ep *gousb.OutEndpoint, in <-chan interface{}, sent chan<- bool
         },
     )
 
-    for obj := range in {
+    writeObject := func(obj interface{}) {
         var body []byte
         var err error
 
@@ -63,26 +89,51 @@ func WriteReports(ep *gousb.OutEndpoint, in <-chan interface{}, sent chan<- bool
         }
 
         length := len(body)
-        if length > 32767 {  // Java short's max value
+        if length > maxFramePayload {
             LogInfo("USB not writing. Payload too long:", string(body))
             sent <- false
-            continue
+            return
         }
 
         LogDebugf("Writing USB Payload (%d bytes): %s", length, string(body))
 
-        header := make([]byte, 2)
-        binary.BigEndian.PutUint16(header, uint16(length))
-
-        if _,err = ep.Write(header); err != nil {
+        if version == ProtocolUnframed {
+            b := make([]byte, 2 + length)
+            binary.BigEndian.PutUint16(b, uint16(length))
+            copy(b[2:], body)
+            _, err = ep.Write(b)
+        } else {
+            err = WriteFrame(ep, &Frame{ControlChannel, 0, body})
+        }
+        if err != nil {
             panic(err)
         }
 
-        if _,err = ep.Write(body); err != nil {
+        sent <- true
+    }
+
+    writeData := func(f *Frame) {
+        if err := WriteFrame(ep, f); err != nil {
             panic(err)
         }
+    }
 
-        sent <- true
+    for {
+        select {
+        case obj, ok := <-in:
+            if !ok { return }
+            writeObject(obj)
+            continue
+        default:
+        }
+
+        select {
+        case obj, ok := <-in:
+            if !ok { return }
+            writeObject(obj)
+        case f := <-data:
+            writeData(f)
+        }
     }
 }
 
@@ -101,8 +152,17 @@ func Interact(stack *AccessoryModeStack) {
         },
     )
 
-    usbIn := make(chan *Command)
-    go ReadCommands(stack.ReadStream, usbIn)
+    // Version 2 clients are still served, without channels.
+    r := bufio.NewReader(stack.ReadStream)
+    version, err := DetectProtocolVersion(r)
+    if err != nil {
+        LogDebug("Cannot read first command:", err)
+        return
+    }
+    LogDebug("Client protocol version:", version)
+
+    usbIn, framesIn := make(chan *Command), make(chan *Frame)
+    go ReadCommands(r, version, usbIn, framesIn)
 
     // For children to communicate state changes to parent.
     // Right now, the only state change is "Terminate abnormally".
@@ -115,10 +175,14 @@ func Interact(stack *AccessoryModeStack) {
         monitorId
         executorId
         scannerId
+        healthId
+        resourcesId
+        tunnelsId
     )
 
     usbOut, sentIn := make(chan interface{}, 9), make(chan bool)
-    go WriteReports(stack.OutEndpoint, usbOut, sentIn, notifyIn, usbWriterId)
+    usbData := make(chan *Frame)
+    go WriteReports(stack.OutEndpoint, version, usbOut, usbData, sentIn, notifyIn, usbWriterId)
     defer close(usbOut)  // terminate writer
     usbWriterLive := true
     usbWriterPending := 0
@@ -131,6 +195,19 @@ func Interact(stack *AccessoryModeStack) {
     //   or stream closed inadvertently on the app side. We can expect user to
     //   open the app or re-plug USB very soon.
 
+    // Returns false if writer seems blocked, in which case I should die.
+    write := func(obj interface{}) bool {
+        if usbWriterPending > USB_WRITER_PENDING_MAX {
+            LogInfof(
+                "USB pending-counter exceeds %d, writer seems blocked, I am dying.",
+                USB_WRITER_PENDING_MAX)
+            return false
+        }
+        usbOut <- obj
+        usbWriterPending++
+        return true
+    }
+
     monitorControlOut, monitorReportsIn := make(chan int, 9), make(chan *MonitorReport)
     go MonitorSystem(monitorControlOut, monitorReportsIn, notifyIn, monitorId)
     defer close(monitorControlOut)  // terminate monitor
@@ -146,6 +223,22 @@ func Interact(stack *AccessoryModeStack) {
     defer close(scannerControlOut)
     scannerLive := true
 
+    healthControlOut, healthReportsIn := make(chan int, 9), make(chan interface{})
+    go MonitorHealth(healthControlOut, healthReportsIn, notifyIn, healthId)
+    defer close(healthControlOut)
+    healthLive := true
+
+    resourcesControlOut, resourcesReportsIn := make(chan int, 9), make(chan *ResourcesReport)
+    go MonitorResources(resourcesControlOut, resourcesReportsIn, notifyIn, resourcesId)
+    defer close(resourcesControlOut)
+    resourcesLive := true
+
+    // Tunnels write to USB directly, only as fast as the writer takes frames.
+    tunnelsOut := make(chan interface{}, 9)
+    go ForwardTunnels(tunnelsOut, usbData, notifyIn, tunnelsId)
+    defer close(tunnelsOut)
+    tunnelsLive := true
+
     choicesRetrieved := false
 
     for {
@@ -164,64 +257,90 @@ func Interact(stack *AccessoryModeStack) {
                     switch command.Args[0] {
                     case "start":
                         if !choicesRetrieved {
-                            usbOut <- RetrieveChoices()
+                            if !write(RetrieveDevice()) { return }
+                            if !write(RetrieveSecurity()) { return }
+                            if !write(RetrieveChoices()) { return }
                             choicesRetrieved = true
                         }
                         monitorControlOut <- MonitorStart
+                        if healthLive { healthControlOut <- HealthStart }
 
-                    case "stop":  monitorControlOut <- MonitorStop
+                    case "stop":
+                        monitorControlOut <- MonitorStop
+                        if healthLive { healthControlOut <- HealthStop }
                     }
                 }
             case "scan":
                 if scannerLive {
                     switch command.Args[0] {
-                    case "start": scannerControlOut <- ScanStart
+                    case "start":
+                        if len(command.Args) > 1 && command.Args[1] == "detail" {
+                            scannerControlOut <- ScanStartDetailed
+                        } else {
+                            scannerControlOut <- ScanStart
+                        }
                     case "stop":  scannerControlOut <- ScanStop
                     }
                 }
 
+            case "resources":
+                if resourcesLive {
+                    switch command.Args[0] {
+                    case "start": resourcesControlOut <- ResourcesStart
+                    case "stop":  resourcesControlOut <- ResourcesStop
+                    }
+                }
+
+            case "shell_resize":
+                if tunnelsLive {
+                    tunnelsOut <- command
+                }
+
+            // Tunnels were briefly JSON commands. They are channels now.
+            case "tunnel_open", "tunnel_send", "tunnel_close":
+                if !write(NewCommandRejected(command.Action, "unsupported")) { return }
+
             case "exit":
                 return
 
+            case "cancel":
+                CancelWifi()
+
             default:
                 if executorLive {
-                    commandsOut <- command
-
-                    if CommandIsChangingSystemStates(command) {
-                        if monitorLive { monitorControlOut <- MonitorBurst }
+                    // Executor may be following a connection for a minute or
+                    // two, sending reports meanwhile. Waiting for it here could
+                    // deadlock.
+                    select {
+                    case commandsOut <- command:
+                        if CommandIsChangingSystemStates(command) {
+                            if monitorLive { monitorControlOut <- MonitorBurst }
+                        }
+                    default:
+                        LogInfo("Executor busy, rejecting command:", command.Action)
+                        if !write(NewCommandRejected(command.Action, "busy")) { return }
                     }
                 }
             }
 
         case commandResult := <-commandResultsIn:
             LogDebugf("Executor result received: %v", commandResult)
+            if usbWriterLive && commandResult.Report != nil {
+                if !write(commandResult.Report) { return }
+            }
 
         case monitorReport := <-monitorReportsIn:
             LogDebugf("Monitor report received: %v", monitorReport)
             if usbWriterLive {
-                if usbWriterPending > USB_WRITER_PENDING_MAX {
-                    LogInfof(
-                        "USB pending-counter exceeds %d, writer seems blocked, I am dying.",
-                        USB_WRITER_PENDING_MAX)
-                    return
-                }
-
+                var ok bool
                 if monitorReport == nil {
-                    usbOut <- nil
-                    usbWriterPending++
+                    ok = write(nil)
                 } else if monitorReport.Full {
-                    usbOut <- NewSystemStates(
-                                    monitorReport.Interfaces,
-                                    monitorReport.Services,
-                                    monitorReport.WifiCountryCode)
-                    usbWriterPending++
+                    ok = write(NewSystemStates(monitorReport))
                 } else {
-                    usbOut <- NewSystemStatesChange(
-                                    monitorReport.Interfaces,
-                                    monitorReport.Services,
-                                    monitorReport.WifiCountryCode)
-                    usbWriterPending++
+                    ok = write(NewSystemStatesChange(monitorReport))
                 }
+                if !ok { return }
             }
 
         case <-sentIn:
@@ -229,18 +348,25 @@ func Interact(stack *AccessoryModeStack) {
 
         case scanResult := <-scanResultsIn:
             LogDebugf("Scan result received: %v", scanResult)
+            if usbWriterLive && scanResult != nil {
+                if !write(scanResult) { return }
+            }
+
+        case healthReport := <-healthReportsIn:
+            LogDebugf("Health report received: %v", healthReport)
             if usbWriterLive {
-                if usbWriterPending > USB_WRITER_PENDING_MAX {
-                    LogInfof(
-                        "USB pending-counter exceeds %d, writer seems blocked, I am dying.",
-                        USB_WRITER_PENDING_MAX)
-                    return
-                }
+                if !write(healthReport) { return }
+            }
 
-                if scanResult != nil {
-                    usbOut <- scanResult
-                    usbWriterPending++
-                }
+        case resourcesReport := <-resourcesReportsIn:
+            LogDebugf("Resources report received: %v", resourcesReport)
+            if usbWriterLive {
+                if !write(resourcesReport) { return }
+            }
+
+        case frame := <-framesIn:
+            if tunnelsLive {
+                tunnelsOut <- frame
             }
 
         case child := <-notifyIn:
@@ -257,6 +383,15 @@ func Interact(stack *AccessoryModeStack) {
             case scannerId:
                 scannerLive = false
                 LogDebug("Scanner died")
+            case healthId:
+                healthLive = false
+                LogDebug("Health monitor died")
+            case resourcesId:
+                resourcesLive = false
+                LogDebug("Resource monitor died")
+            case tunnelsId:
+                tunnelsLive = false
+                LogDebug("Tunnels died")
             }
         }
     }
@@ -270,6 +405,18 @@ func Init() bool {
     scriptDirectory := flag.String("d", "", "Helper script directory")
     lessOutput := flag.Bool("z", false, "Less output")
     printVersion := flag.Bool("version", false, "Print version number and exit")
+    connectTimeout := flag.Duration("connect-timeout", 60 * time.Second, "Time allowed for a new WiFi network to connect")
+    noRollback := flag.Bool("no-rollback", false, "Keep new WiFi config even if it fails to connect")
+    probeTarget := flag.String("probe", probeTarget, "Internet reachability probe, HTTP URL or host:port. Empty to disable.")
+    forceTime := flag.Bool("force-time", false, "Set clock from client even if NTP-synchronised")
+    tunnelPorts := flag.String("tunnel-ports", "22,5900", "Comma-separated local ports the client may tunnel to. Empty to disable.")
+    allowShell := flag.Bool("shell", false, "Allow the client to open a shell")
+    shellCommand := flag.String("shell-command", "/bin/login", "Command run in a shell opened by the client")
+    requireNewPassword := flag.Bool("require-new-password", false, "Refuse to enable SSH while a default password remains")
+    fallbackAp := flag.Duration("fallback-ap", 0, "Bring up a setup access point after this long without connectivity. 0 to disable.")
+    fallbackPassphrase := flag.String("fallback-passphrase", "", "Setup access point passphrase, 8 to 63 characters. Empty for an open network.")
+    stateDirectory := flag.String("state-dir", stateDirectory, "Directory for state kept across restarts")
+    sysRoot := flag.String("sysroot", "/", "Root directory for reading /proc, /sys and /etc files, e.g. test fixtures")
 
     flag.Parse()
 
@@ -285,6 +432,30 @@ func Init() bool {
         SetLogLevel(Debug)
     }
 
+    SetConnectTimeout(*connectTimeout)
+    SetRollback(!*noRollback)
+    SetProbeTarget(*probeTarget)
+    SetSysRoot(*sysRoot)
+    SetForceTime(*forceTime)
+    SetStateDirectory(*stateDirectory)
+
+    if n := len(*fallbackPassphrase); n > 0 && (n < 8 || n > 63) {
+        fmt.Println("Setup access point passphrase must be 8 to 63 characters.")
+        return false
+    }
+    SetFallbackAp(*fallbackAp, *fallbackPassphrase)
+    ports, err := parsePorts(*tunnelPorts)
+    if err != nil {
+        fmt.Println(err)
+        return false
+    }
+    SetPolicy(Policy{
+        RequireNewPassword: *requireNewPassword,
+        TunnelPorts: ports,
+        AllowShell: *allowShell,
+        ShellCommand: *shellCommand,
+    })
+
     if (*scriptDirectory == "") {
         fmt.Println("No specified helper script directory. Use -d to specify.")
         return false
@@ -317,11 +488,17 @@ func Check() {
 func main() {
     if !Init() { return }
     Check()
+    RestoreDeadlines()
+    go ExpireServices()
+    go FallbackAp()
     for {
         func() {
             s := OpenAccessoryModeStack()
             defer s.Close()
 
+            SetPhoneAttached(true)
+            defer SetPhoneAttached(false)
+
             Interact(s)
         }()
     }
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// What a client is allowed to do to the Pi, set by command-line flags
+type Policy struct {
+    // Refuse to enable SSH while any user has a default password
+    RequireNewPassword bool
+
+    // Local ports the client may open tunnels to
+    TunnelPorts []int
+
+    // Whether the client may open a shell, and what runs in it
+    AllowShell bool
+    ShellCommand string
+}
+
+func (p Policy) tunnelPortAllowed(port int) bool {
+    for _,n := range p.TunnelPorts {
+        if n == port {
+            return true
+        }
+    }
+    return false
+}
+
+var policy Policy
+
+func parsePorts(s string) ([]int, error) {
+    var ports []int
+    for _,x := range strings.Split(s, ",") {
+        if x = strings.TrimSpace(x); x == "" {
+            continue
+        }
+        n, err := strconv.Atoi(x)
+        if err != nil || n < 1 || n > 65535 {
+            return nil, fmt.Errorf("Invalid port: %v", x)
+        }
+        ports = append(ports, n)
+    }
+    return ports, nil
+}
+
+func SetPolicy(p Policy) {
+    policy = p
+}
+
+// The client may require a password change too. Kept across restarts.
+func clientPolicyPath() string {
+    return filepath.Join(stateDirectory, "require-new-password")
+}
+
+func PasswordChangeRequired() bool {
+    if policy.RequireNewPassword {
+        return true
+    }
+    _, err := os.Stat(clientPolicyPath())
+    return err == nil
+}
+
+// A client cannot lift what the server requires.
+func SetClientRequireNewPassword(on bool) error {
+    if !on {
+        if policy.RequireNewPassword {
+            return fmt.Errorf("Password change is required by the server")
+        }
+        err := os.Remove(clientPolicyPath())
+        if os.IsNotExist(err) {
+            return nil
+        }
+        return err
+    }
+
+    if err := os.MkdirAll(stateDirectory, 0700); err != nil {
+        return err
+    }
+    return ioutil.WriteFile(clientPolicyPath(), nil, 0600)
+}
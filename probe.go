@@ -0,0 +1,109 @@
+package main
+
+import (
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+const (
+    ReachabilityUnknown = "unknown"
+    ReachabilityDisabled = "disabled"
+    ReachabilityOnline = "online"
+    ReachabilityCaptivePortal = "captive_portal"
+    ReachabilityDnsFailure = "dns_failure"
+    ReachabilityNoRoute = "no_route"
+)
+
+// Either an HTTP(S) URL, or host:port to open a TCP connection to. An HTTP
+// probe can detect captive portals, a TCP probe cannot.
+var probeTarget = "http://connectivitycheck.gstatic.com/generate_204"
+
+func SetProbeTarget(t string) {
+    probeTarget = t
+}
+
+const (
+    probeTimeout = 5 * time.Second
+    probeInterval = 30 * time.Second
+)
+
+func probeHost() (host string, port string, isHttp bool) {
+    if u, err := url.Parse(probeTarget); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+        port = u.Port()
+        if port == "" {
+            port = u.Scheme
+        }
+        return u.Hostname(), port, true
+    }
+
+    host, port, err := net.SplitHostPort(probeTarget)
+    if err != nil {
+        return probeTarget, "", false
+    }
+    return host, port, false
+}
+
+func probeHttp() string {
+    client := &http.Client{
+        Timeout: probeTimeout,
+        // A captive portal redirects to its login page. Don't follow.
+        CheckRedirect: func(*http.Request, []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+    }
+
+    resp, err := client.Get(probeTarget)
+    if err != nil {
+        return ReachabilityNoRoute
+    }
+    resp.Body.Close()
+
+    // A generate_204 URL answers with nothing but 204. Anything else comes
+    // from whoever is intercepting traffic.
+    switch {
+    case strings.Contains(probeTarget, "generate_204") && resp.StatusCode != http.StatusNoContent:
+        return ReachabilityCaptivePortal
+    case resp.StatusCode >= 200 && resp.StatusCode < 300:
+        return ReachabilityOnline
+    default:
+        return ReachabilityCaptivePortal
+    }
+}
+
+func ProbeReachability() *Reachability {
+    if probeTarget == "" {
+        return &Reachability{ReachabilityDisabled, ""}
+    }
+
+    r := &Reachability{ReachabilityUnknown, probeTarget}
+
+    if len(DefaultRoutes()) == 0 {
+        r.Status = ReachabilityNoRoute
+        return r
+    }
+
+    host, port, isHttp := probeHost()
+    if net.ParseIP(host) == nil {
+        if _, err := net.LookupHost(host); err != nil {
+            r.Status = ReachabilityDnsFailure
+            return r
+        }
+    }
+
+    if isHttp {
+        r.Status = probeHttp()
+        return r
+    }
+
+    conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), probeTimeout)
+    if err != nil {
+        r.Status = ReachabilityNoRoute
+    } else {
+        conn.Close()
+        r.Status = ReachabilityOnline
+    }
+    return r
+}
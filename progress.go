@@ -0,0 +1,225 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "time"
+)
+
+// Stages reported while following wpa_supplicant towards a connection
+const (
+    StageStarted = "started"
+    StageScanning = "scanning"
+    StageAssociating = "associating"
+    StageHandshake = "handshake"
+    StageObtainingIP = "obtaining_ip"
+    StageCompleted = "completed"
+    StageDisconnected = "disconnected"
+    StageFailed = "failed"
+)
+
+// Why a connection failed
+const (
+    ReasonWrongKey = "wrong_key"
+    ReasonNotFound = "not_found"
+    ReasonDhcpTimeout = "dhcp_timeout"
+    ReasonCountryNotSet = "country_not_set"
+    ReasonTimeout = "timeout"
+    ReasonCancelled = "cancelled"
+)
+
+type ConnectionError struct {
+    Reason string
+    Message string
+}
+
+func (e *ConnectionError) Error() string {
+    return e.Message
+}
+
+func stageOf(wpaState string) string {
+    switch wpaState {
+    case "SCANNING":
+        return StageScanning
+    case "AUTHENTICATING", "ASSOCIATING", "ASSOCIATED":
+        return StageAssociating
+    case "4WAY_HANDSHAKE", "GROUP_HANDSHAKE":
+        return StageHandshake
+    case "COMPLETED":
+        return StageCompleted
+    default:
+        return StageDisconnected
+    }
+}
+
+const (
+    // Give up if access point is not seen within this time
+    notFoundTimeout = 20 * time.Second
+    // After association, DHCP should not take longer than this
+    dhcpTimeout = 20 * time.Second
+)
+
+// Give up altogether
+var connectTimeout = 60 * time.Second
+
+func SetConnectTimeout(d time.Duration) {
+    connectTimeout = d
+}
+
+// Restore previous WiFi config if a new network fails to connect
+var rollbackEnabled = true
+
+func SetRollback(b bool) {
+    rollbackEnabled = b
+}
+
+func networkIsFailing(ssid string) bool {
+    networks,_ := SavedWifiNetworks()
+    for _,n := range networks {
+        if n.SSID == ssid && n.Failing {
+            return true
+        }
+    }
+    return false
+}
+
+// Follow wpa_supplicant's state machine until connected to ssid and given an
+// IP address, reporting each change of stage. Failures are classified into
+// a ConnectionError.
+func followConnection(action string, ssid string, report func(interface{})) error {
+    fail := func(reason string, format string, a ...interface{}) error {
+        err := &ConnectionError{reason, fmt.Sprintf(format, a...)}
+        p := NewProgressFailure(action, err)
+        p.SSID, p.Reason = ssid, reason
+        report(p)
+        return err
+    }
+
+    if code,_ := WifiCountryCode(); code == "" {
+        return fail(ReasonCountryNotSet, "WiFi country is not set")
+    }
+
+    // A wrong key is told by wpa_supplicant. Without its events, a network
+    // disabled after failing is the best guess.
+    done := make(chan struct{})
+    defer close(done)
+    wrongKey, err := WatchWrongKey(ssid, done)
+    if err != nil {
+        LogDebug("Cannot watch wpa_supplicant events:", err)
+    }
+
+    start := time.Now()
+    last := ""
+    var associated time.Time
+    handshaking := false
+
+    for time.Since(start) < connectTimeout {
+        if !waitUnlessCancelled() {
+            return fail(ReasonCancelled, "Connecting to %v cancelled", ssid)
+        }
+
+        select {
+        case <-wrongKey:
+            return fail(ReasonWrongKey, "Wrong passphrase or credentials")
+        default:
+        }
+
+        status, err := WifiStatus()
+        if err != nil {
+            LogDebug("Cannot obtain WiFi status:", err)
+            continue
+        }
+
+        stage := stageOf(strings.ToUpper(status["wpa_state"]))
+
+        // Still on some other network, not yet moved
+        if stage == StageCompleted && status["ssid"] != ssid {
+            stage = StageScanning
+        }
+
+        if stage == StageCompleted && status["ip_address"] == "" {
+            stage = StageObtainingIP
+        }
+
+        if stage != last {
+            last = stage
+            p := NewProgress(action, stage)
+            p.SSID = ssid
+            if stage == StageCompleted {
+                p.Done = true
+            }
+            report(p)
+        }
+
+        switch stage {
+        case StageCompleted:
+            return nil
+
+        case StageObtainingIP:
+            if associated.IsZero() {
+                associated = time.Now()
+            } else if time.Since(associated) > dhcpTimeout {
+                return fail(ReasonDhcpTimeout, "No IP address from DHCP")
+            }
+
+        case StageHandshake:
+            handshaking = true
+
+        case StageScanning, StageDisconnected:
+            associated = time.Time{}
+            if wrongKey == nil && networkIsFailing(ssid) {
+                return fail(ReasonWrongKey, "Wrong passphrase or credentials")
+            }
+            if !handshaking && time.Since(start) > notFoundTimeout {
+                return fail(ReasonNotFound, "Cannot find %v", ssid)
+            }
+        }
+    }
+    return fail(ReasonTimeout, "Timed out connecting to %v", ssid)
+}
+
+// Apply a network change with connect(), then follow it through. If it fails
+// to connect, WiFi config is restored to what it was before.
+func connectAndFollow(action string, ssid string, connect func() error, report func(interface{})) error {
+    resetWifiCancel()
+
+    p := NewProgress(action, StageStarted)
+    p.SSID = ssid
+    report(p)
+
+    transact := rollbackEnabled
+    if transact {
+        if _, err := raspi_config("backup_wifi_config"); err != nil {
+            LogInfo("Cannot back up WiFi config, changing without rollback:", err)
+            transact = false
+        }
+    }
+
+    err := connect()
+    if err != nil {
+        p := NewProgressFailure(action, err)
+        p.SSID = ssid
+        report(p)
+    } else {
+        err = followConnection(action, ssid, report)
+    }
+
+    if !transact {
+        return err
+    }
+
+    if err == nil {
+        raspi_config("discard_wifi_config_backup")
+        report(NewTransaction(action, ssid, OutcomeCommitted, nil))
+        return nil
+    }
+
+    LogInfof("Cannot connect to %v, restoring WiFi config: %v", ssid, err)
+    if _, e := raspi_config("restore_wifi_config"); e != nil {
+        LogInfo("Cannot restore WiFi config:", e)
+        report(NewTransaction(action, ssid, OutcomeRollbackFailed, err))
+    } else {
+        report(NewTransaction(action, ssid, OutcomeRolledBack, err))
+    }
+    return err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+)
+
+func readLoadAverage() [3]float64 {
+    var load [3]float64
+    s, err := readSysFile("/proc/loadavg")
+    if err != nil {
+        LogDebug("Cannot read load average:", err)
+        return load
+    }
+
+    f := strings.Fields(s)
+    for i := 0; i < 3 && i < len(f); i++ {
+        load[i],_ = strconv.ParseFloat(f[i], 64)
+    }
+    return load
+}
+
+// Values in /proc/meminfo are in kB
+func readMemory() (memory Usage, swap Usage) {
+    s, err := readSysFile("/proc/meminfo")
+    if err != nil {
+        LogDebug("Cannot read memory usage:", err)
+        return
+    }
+
+    info := make(map[string]uint64)
+    for k,v := range parseKeyValues(s, ":") {
+        f := strings.Fields(v)
+        if len(f) > 0 {
+            n,_ := strconv.ParseUint(f[0], 10, 64)
+            info[k] = n * 1024
+        }
+    }
+
+    memory = Usage{info["MemTotal"], info["MemAvailable"]}
+    swap = Usage{info["SwapTotal"], info["SwapFree"]}
+    return
+}
+
+func readDisk(path string) Usage {
+    var st syscall.Statfs_t
+    if err := syscall.Statfs(path, &st); err != nil {
+        LogDebug("Cannot read disk usage:", err)
+        return Usage{}
+    }
+    bsize := uint64(st.Bsize)
+    return Usage{uint64(st.Blocks) * bsize, uint64(st.Bavail) * bsize}
+}
+
+// Byte counters from /proc/net/dev
+func readTraffic() []Traffic {
+    traffic := make([]Traffic, 0)  // ensure not nil
+
+    f, err := openSysFile("/proc/net/dev")
+    if err != nil {
+        LogDebug("Cannot read interface traffic:", err)
+        return traffic
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        // "  eth0: rx_bytes rx_packets ... (8 rx fields) tx_bytes ..."
+        nv := strings.SplitN(scanner.Text(), ":", 2)
+        if len(nv) != 2 { continue }  // header lines
+
+        name := strings.TrimSpace(nv[0])
+        c := strings.Fields(nv[1])
+        if name == "lo" || len(c) < 9 { continue }
+
+        rx,_ := strconv.ParseUint(c[0], 10, 64)
+        tx,_ := strconv.ParseUint(c[8], 10, 64)
+        traffic = append(traffic, Traffic{name, rx, tx})
+    }
+    return traffic
+}
+
+func inspectResources() *ResourcesReport {
+    memory, swap := readMemory()
+    return &ResourcesReport{
+        "resources",
+        readLoadAverage(),
+        memory,
+        swap,
+        readDisk("/"),
+        readTraffic(),
+    }
+}
+
+const (
+    ResourcesStart = 1 << iota
+    ResourcesStop
+)
+
+func MonitorResources(in <-chan int, out chan<- *ResourcesReport, notify chan<- int, id int) {
+    defer RecoverDo(
+        func(x interface{}) {
+            notify <- id
+            LogDebug("Resource monitor terminates due to:", x)
+        },
+        func() {
+            LogDebug("Resource monitor terminates normally")
+        },
+    )
+
+    ticker := time.NewTicker(5 * time.Second)
+    defer ticker.Stop()
+    active := false
+
+    for {
+        select {
+        case ctrl, ok := <-in:
+            if !ok { return }
+
+            switch ctrl {
+            case ResourcesStart:
+                active = true
+                out <- inspectResources()
+            case ResourcesStop:
+                active = false
+            default:
+                panic(fmt.Sprintf("Invalid resources control code: %v", ctrl))
+            }
+        case <-ticker.C:
+            if active {
+                out <- inspectResources()
+            }
+        }
+    }
+}
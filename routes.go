@@ -0,0 +1,129 @@
+package main
+
+import (
+    "bufio"
+    "encoding/binary"
+    "encoding/hex"
+    "net"
+    "strconv"
+    "strings"
+)
+
+const (
+    rtfGateway = 0x0002
+    rtfReject = 0x0200
+)
+
+func parseRouteFlags(s string) int64 {
+    f,_ := strconv.ParseInt(s, 16, 64)
+    return f
+}
+
+// IPv4 default routes from /proc/net/route. Addresses there are in host byte
+// order, which is little-endian on the Pi.
+func defaultRoutes4() []Route {
+    var routes []Route
+
+    f, err := openSysFile("/proc/net/route")
+    if err != nil {
+        LogDebug("Cannot read IPv4 routes:", err)
+        return routes
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    scanner.Scan()  // skip header
+    for scanner.Scan() {
+        // Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+        c := strings.Fields(scanner.Text())
+        if len(c) < 8 || c[1] != "00000000" || c[7] != "00000000" { continue }
+        if parseRouteFlags(c[3]) & rtfReject != 0 { continue }
+
+        gw, err := strconv.ParseUint(c[2], 16, 32)
+        if err != nil { continue }
+
+        ip := make(net.IP, 4)
+        binary.LittleEndian.PutUint32(ip, uint32(gw))
+
+        metric,_ := strconv.Atoi(c[6])
+        routes = append(routes, Route{c[0], ip.String(), FamilyIPv4, metric})
+    }
+    return routes
+}
+
+// IPv6 default routes from /proc/net/ipv6_route
+func defaultRoutes6() []Route {
+    var routes []Route
+
+    f, err := openSysFile("/proc/net/ipv6_route")
+    if err != nil {
+        LogDebug("Cannot read IPv6 routes:", err)
+        return routes
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        // dest dest_prefix src src_prefix next_hop metric refcnt use flags iface
+        c := strings.Fields(scanner.Text())
+        if len(c) < 10 || c[1] != "00" || strings.Trim(c[0], "0") != "" { continue }
+        if c[9] == "lo" || parseRouteFlags(c[8]) & rtfReject != 0 { continue }
+
+        b, err := hex.DecodeString(c[4])
+        if err != nil || len(b) != net.IPv6len { continue }
+
+        metric,_ := strconv.ParseInt(c[5], 16, 64)
+        routes = append(routes, Route{c[9], net.IP(b).String(), FamilyIPv6, int(metric)})
+    }
+    return routes
+}
+
+func DefaultRoutes() []Route {
+    routes := make([]Route, 0)  // ensure not nil
+    routes = append(routes, defaultRoutes4()...)
+    return append(routes, defaultRoutes6()...)
+}
+
+func DnsServers() []string {
+    servers := make([]string, 0)  // ensure not nil
+
+    f, err := openSysFile("/etc/resolv.conf")
+    if err != nil {
+        LogDebug("Cannot read DNS servers:", err)
+        return servers
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        c := strings.Fields(scanner.Text())
+        if len(c) >= 2 && c[0] == "nameserver" {
+            servers = append(servers, c[1])
+        }
+    }
+    return servers
+}
+
+func routesEqual(a []Route, b []Route) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+func stringsEqual(a []string, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+func securityOfKeyMgmt(keyMgmt string) string {
+    switch {
+    case strings.Contains(keyMgmt, "EAP"): return SecurityEAP
+    case strings.Contains(keyMgmt, "PSK"): return SecurityPSK
+    default: return SecurityOpen
+    }
+}
+
+// Networks remembered by wpa_supplicant, in the order of its config file
+func SavedWifiNetworks() ([]SavedNetwork, error) {
+    networks := make([]SavedNetwork, 0)  // ensure not nil
+    out, err := raspi_config("list_wifi_networks")
+    if err != nil {
+        return networks, err
+    }
+
+    for _,n := range strings.Split(strings.TrimSpace(out), "\n") {
+        // network id, ssid, flags, priority, key_mgmt
+        f := strings.Split(n, "\t")
+        if len(f) < 5 { continue }
+
+        priority,_ := strconv.Atoi(strings.TrimSpace(f[3]))
+        networks = append(networks, SavedNetwork{
+                        ID: f[0],
+                        SSID: f[1],
+                        Priority: priority,
+                        Security: securityOfKeyMgmt(f[4]),
+                        Autoconnect: !strings.Contains(f[2], "[DISABLED]"),
+                        Current: strings.Contains(f[2], "[CURRENT]"),
+                        Failing: strings.Contains(f[2], "[TEMP-DISABLED]")})
+    }
+    return networks, err
+}
+
+// SSIDs remembered by wpa_supplicant. Always returns a usable set.
+func SavedSsids() (*StringSet, error) {
+    ss := NewStringSet()
+    networks, err := SavedWifiNetworks()
+    for _,n := range networks {
+        ss.Add(n.SSID)
+    }
+    return ss, err
+}
+
+func savedNetworksReport() *SavedNetworks {
+    networks, err := SavedWifiNetworks()
+    if err != nil {
+        LogDebug("Cannot obtain saved networks:", err)
+    }
+    return NewSavedNetworks(networks)
+}
+
+func WifiForget(ssid string) error {
+    _, err := raspi_config("do_wifi_forget", ssid)
+    return err
+}
+
+func WifiSetPriority(ssid string, priority string) error {
+    if _, err := strconv.Atoi(priority); err != nil {
+        return fmt.Errorf("Invalid priority: %v", priority)
+    }
+    _, err := raspi_config("do_wifi_priority", ssid, priority)
+    return err
+}
+
+func WifiSetAutoconnect(ssid string, on bool) error {
+    code := "1"
+    if on {
+        code = "0"
+    }
+    _, err := raspi_config("do_wifi_autoconnect", ssid, code)
+    return err
+}
+
+func WifiSwitch(ssid string, report func(interface{})) error {
+    resetWifiCancel()
+    networks, err := SavedWifiNetworks()
+    if err != nil {
+        return err
+    }
+
+    // select_network disables every other network. Remember which ones
+    // were enabled, so I can restore them after switching.
+    var enabled []string
+    for _,n := range networks {
+        if n.Autoconnect && n.SSID != ssid {
+            enabled = append(enabled, n.ID)
+        }
+    }
+
+    if _, err = raspi_config("do_wifi_select", ssid); err != nil {
+        return err
+    }
+    defer raspi_config(append([]string{"enable_wifi_network_ids"}, enabled...)...)
+
+    return followConnection("switch", ssid, report)
+}
@@ -4,7 +4,9 @@ import (
     "fmt"
     "os/exec"
     "regexp"
+    "sort"
     "strconv"
+    "strings"
     "time"
 )
 
@@ -19,32 +21,182 @@ func ssidIsValid(ssid string) bool {
     return true
 }
 
-var infoPattern = regexp.MustCompile(`(?ms)Signal level=(-[0-9]+) dBm.*?Encryption key:(on|off).*?ESSID:"(.*?)"`)
+var (
+    cellPattern = regexp.MustCompile(`Cell [0-9]+ - Address: ([0-9A-Fa-f:]{17})`)
+    frequencyPattern = regexp.MustCompile(`Frequency:([0-9.]+) GHz`)
+    signalPattern = regexp.MustCompile(`Signal level=(-[0-9]+) dBm`)
+    encryptionPattern = regexp.MustCompile(`Encryption key:(on|off)`)
+    essidPattern = regexp.MustCompile(`(?m)ESSID:"(.*)"$`)
+    wpaPattern = regexp.MustCompile(`IE: (IEEE 802\.11i/WPA2|WPA) Version`)
+    authPattern = regexp.MustCompile(`Authentication Suites \([0-9]+\) : (.*)`)
+)
 
-func scanForResult() *ScanResult {
-    out, err := exec.Command("iwlist", "scan").Output()
-    if err != nil {
-        LogDebug("iwlist failed:", err)
-        return nil
+// One access point, as seen by `iwlist scan`
+type cell struct {
+    BSS
+    SSID string
+    Security string
+}
+
+func parseSecurity(section string, encryption string) string {
+    if encryption == "off" {
+        return SecurityOpen
     }
+    if !wpaPattern.MatchString(section) {
+        return SecurityWEP
+    }
+    for _,a := range authPattern.FindAllStringSubmatch(section, -1) {
+        if strings.Contains(a[1], "802.1x") {
+            return SecurityEAP
+        }
+    }
+    return SecurityPSK
+}
+
+func parseCells(out string) []cell {
+    var cells []cell
+
+    bounds := cellPattern.FindAllStringSubmatchIndex(out, -1)
+    for n,b := range bounds {
+        end := len(out)
+        if n+1 < len(bounds) {
+            end = bounds[n+1][0]
+        }
+        section := out[b[1]:end]
+        bssid := strings.ToLower(out[b[2]:b[3]])
 
-    sections := infoPattern.FindAllStringSubmatch(string(out), -1)
+        signal := signalPattern.FindStringSubmatch(section)
+        encryption := encryptionPattern.FindStringSubmatch(section)
+        essid := essidPattern.FindStringSubmatch(section)
+        if signal == nil || encryption == nil || essid == nil { continue }
 
-    hotspots := make([]Hotspot, 0)  // ensure not nil
-    for _,s := range sections {
-        signalLevel, encryption, ssid := s[1], s[2], s[3]
+        ssid := essid[1]
         if !ssidIsValid(ssid) { continue }
 
-        signal, err := strconv.Atoi(signalLevel)
+        level, err := strconv.Atoi(signal[1])
         if err != nil { continue }
 
-        hotspots = append(hotspots, Hotspot{ssid, encryption=="off", signal})
+        mhz := 0
+        if f := frequencyPattern.FindStringSubmatch(section); f != nil {
+            ghz, err := strconv.ParseFloat(f[1], 64)
+            if err == nil {
+                mhz = int(ghz * 1000 + 0.5)
+            }
+        }
+
+        cells = append(cells, cell{
+                    BSS{bssid, level, mhz},
+                    ssid,
+                    parseSecurity(section, encryption[1])})
+    }
+    return cells
+}
+
+func bandOf(mhz int) string {
+    switch {
+    case mhz >= 2400 && mhz < 2500: return Band2GHz
+    case mhz >= 4900 && mhz < 5900: return Band5GHz
+    default: return ""
+    }
+}
+
+// Group access points by SSID and security, so that a network with many
+// access points shows up once.
+func groupCells(cells []cell, connected string, saved *StringSet, detailed bool) []Hotspot {
+    type key struct { ssid, security string }
+
+    var order []key
+    groups := make(map[key]*Hotspot)
+
+    for _,c := range cells {
+        k := key{c.SSID, c.Security}
+        h, ok := groups[k]
+        if !ok {
+            h = &Hotspot{
+                    SSID: c.SSID,
+                    Open: c.Security == SecurityOpen,
+                    Security: c.Security,
+                    Signal: c.Signal,
+                    Bands: make([]string, 0),
+                    Connected: c.SSID == connected,
+                    Saved: saved.Contain(c.SSID)}
+            groups[k] = h
+            order = append(order, k)
+        }
+
+        if c.Signal > h.Signal {
+            h.Signal = c.Signal
+        }
+        h.Count++
+
+        if b := bandOf(c.Frequency); b != "" && !containString(h.Bands, b) {
+            h.Bands = append(h.Bands, b)
+            sort.Strings(h.Bands)
+        }
+
+        if detailed {
+            h.BSSes = append(h.BSSes, c.BSS)
+        }
+    }
+
+    hotspots := make([]Hotspot, len(order))  // ensure not nil
+    for i,k := range order {
+        hotspots[i] = *groups[k]
+    }
+    sort.Sort(byUsefulness(hotspots))
+    return hotspots
+}
+
+// Connected network first, then saved networks, then by signal strength.
+type byUsefulness []Hotspot
+
+func (hs byUsefulness) Len() int { return len(hs) }
+func (hs byUsefulness) Swap(i, j int) { hs[i], hs[j] = hs[j], hs[i] }
+func (hs byUsefulness) Less(i, j int) bool {
+    a, b := hs[i], hs[j]
+    switch {
+    case a.Connected != b.Connected: return a.Connected
+    case a.Saved != b.Saved: return a.Saved
+    case a.Signal != b.Signal: return a.Signal > b.Signal
+    default: return a.SSID < b.SSID
+    }
+}
+
+func containString(ss []string, s string) bool {
+    for _,x := range ss {
+        if x == s { return true }
+    }
+    return false
+}
+
+func connectedSsid() string {
+    wlan, err := DefaultWlanInterface()
+    if err != nil || wlan == "" {
+        return ""
     }
-    return NewScanResult(hotspots)
+    ssid,_ := ReportSsid(wlan)
+    return ssid
+}
+
+func scanForResult(detailed bool) *ScanResult {
+    out, err := exec.Command("iwlist", "scan").Output()
+    if err != nil {
+        LogDebug("iwlist failed:", err)
+        return nil
+    }
+
+    saved, err := SavedSsids()
+    if err != nil {
+        LogDebug("Cannot obtain saved networks:", err)
+    }
+
+    cells := parseCells(string(out))
+    return NewScanResult(groupCells(cells, connectedSsid(), saved, detailed))
 }
 
 const (
     ScanStart = 1 << iota
+    ScanStartDetailed
     ScanStop
 )
 
@@ -62,7 +214,7 @@ func WifiScan(in <-chan int, out chan<- *ScanResult, notify chan<- int, id int)
     // `iwlist scan` can take 5 seconds. I give it some margin.
     ticker := time.NewTicker(6600 * time.Millisecond)
     defer ticker.Stop()
-    active := false
+    active, detailed := false, false
     cool := 0
 
     filter := func(r *ScanResult) {
@@ -86,9 +238,9 @@ func WifiScan(in <-chan int, out chan<- *ScanResult, notify chan<- int, id int)
             if !ok { return }
 
             switch ctrl {
-            case ScanStart:
-                active = true
-                filter(scanForResult())
+            case ScanStart, ScanStartDetailed:
+                active, detailed = true, ctrl == ScanStartDetailed
+                filter(scanForResult(detailed))
             case ScanStop:
                 active = false
             default:
@@ -96,7 +248,7 @@ func WifiScan(in <-chan int, out chan<- *ScanResult, notify chan<- int, id int)
             }
         case <-ticker.C:
             if active {
-                filter(scanForResult())
+                filter(scanForResult(detailed))
             }
         }
     }
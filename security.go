@@ -0,0 +1,71 @@
+package main
+
+import (
+    "fmt"
+    "os/exec"
+    "os/user"
+    "strings"
+)
+
+// Passwords that come with the image, known to everyone
+var defaultPasswords = map[string]string{
+    "pi": "raspberry",
+}
+
+func DefaultPasswordUsers() []string {
+    users := make([]string, 0)  // ensure not nil
+    for name, password := range defaultPasswords {
+        if _, err := user.Lookup(name); err != nil {
+            continue
+        }
+        if _, err := raspi_config("check_password", name, password); err == nil {
+            users = append(users, name)
+        }
+    }
+    return users
+}
+
+func RetrieveSecurity() *SecurityReport {
+    passwordAuth, err := SshPasswordAuthentication()
+    if err != nil {
+        LogDebug("Cannot obtain SSH password authentication:", err)
+    }
+
+    return &SecurityReport{
+        Type: "security",
+        DefaultPasswordUsers: DefaultPasswordUsers(),
+        PasswordChangeRequired: PasswordChangeRequired(),
+        PasswordChangeByServer: policy.RequireNewPassword,
+        PasswordAuthentication: passwordAuth,
+    }
+}
+
+// Password goes through stdin, so it never shows up in process list.
+func SetPassword(name string, password string) error {
+    if _, err := user.Lookup(name); err != nil {
+        return fmt.Errorf("No such user: %v", name)
+    }
+    if password == "" || strings.ContainsAny(password, "\r\n") {
+        return fmt.Errorf("Invalid password")
+    }
+    if password == defaultPasswords[name] {
+        return fmt.Errorf("Password must not be the default")
+    }
+
+    cmd := exec.Command("chpasswd")
+    cmd.Stdin = strings.NewReader(name + ":" + password + "\n")
+    if out, err := cmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("chpasswd failed: %v %s", err, out)
+    }
+    return nil
+}
+
+// Enabling SSH with a default password puts a wide-open Pi on the network.
+func checkServicePolicy(name string) error {
+    if name == "SSH" && PasswordChangeRequired() {
+        if users := DefaultPasswordUsers(); len(users) > 0 {
+            return fmt.Errorf("Change default password of %v before enabling SSH", strings.Join(users, ", "))
+        }
+    }
+    return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "unsafe"
+)
+
+type winsize struct {
+    Row, Col, Xpixel, Ypixel uint16
+}
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+    if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg)); e != 0 {
+        return e
+    }
+    return nil
+}
+
+// Master is non-blocking, so closing it interrupts a pending Read.
+func openPty() (*os.File, *os.File, error) {
+    fd, err := syscall.Open("/dev/ptmx", syscall.O_RDWR | syscall.O_NOCTTY | syscall.O_CLOEXEC, 0)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    var n uint32
+    var unlock int32
+    if err = ioctl(fd, syscall.TIOCGPTN, unsafe.Pointer(&n)); err == nil {
+        err = ioctl(fd, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock))
+    }
+    if err == nil {
+        err = syscall.SetNonblock(fd, true)
+    }
+    if err != nil {
+        syscall.Close(fd)
+        return nil, nil, err
+    }
+    master := os.NewFile(uintptr(fd), "/dev/ptmx")
+
+    slave, err := os.OpenFile("/dev/pts/" + strconv.Itoa(int(n)), os.O_RDWR | syscall.O_NOCTTY, 0)
+    if err != nil {
+        master.Close()
+        return nil, nil, err
+    }
+    return master, slave, nil
+}
+
+func setPtySize(f *os.File, rows, cols int) error {
+    ws := winsize{Row: uint16(rows), Col: uint16(cols)}
+    conn, err := f.SyscallConn()
+    if err != nil {
+        return err
+    }
+    var e error
+    err = conn.Control(func(fd uintptr) {
+        e = ioctl(int(fd), syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+    })
+    if err != nil {
+        return err
+    }
+    return e
+}
+
+// A command on a PTY, read and written through the master side
+type shellSession struct {
+    *os.File
+    cmd *exec.Cmd
+    closeOnce sync.Once
+}
+
+func checkShellPolicy() error {
+    if !policy.AllowShell {
+        return fmt.Errorf("Shell not allowed")
+    }
+    if PasswordChangeRequired() {
+        if users := DefaultPasswordUsers(); len(users) > 0 {
+            return fmt.Errorf("Change default password of %v before opening a shell", strings.Join(users, ", "))
+        }
+    }
+    return nil
+}
+
+// Size is "<rows>x<cols>", or empty for the default
+func parsePtySize(s string) (int, int, error) {
+    if s == "" {
+        return 24, 80, nil
+    }
+    f := strings.Split(s, "x")
+    if len(f) == 2 {
+        rows, e1 := strconv.Atoi(f[0])
+        cols, e2 := strconv.Atoi(f[1])
+        if e1 == nil && e2 == nil && rows > 0 && rows < 65536 && cols > 0 && cols < 65536 {
+            return rows, cols, nil
+        }
+    }
+    return 0, 0, fmt.Errorf("Invalid terminal size: %v", s)
+}
+
+// In a new session, with the PTY as its controlling terminal
+func StartShell(rows, cols int) (*shellSession, error) {
+    args := strings.Fields(policy.ShellCommand)
+    if len(args) == 0 {
+        return nil, fmt.Errorf("No shell command")
+    }
+
+    master, slave, err := openPty()
+    if err != nil {
+        return nil, err
+    }
+    defer slave.Close()
+
+    if err := setPtySize(master, rows, cols); err != nil {
+        master.Close()
+        return nil, err
+    }
+
+    cmd := exec.Command(args[0], args[1:]...)
+    cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+    cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+
+    if err := cmd.Start(); err != nil {
+        master.Close()
+        return nil, err
+    }
+    return &shellSession{File: master, cmd: cmd}, nil
+}
+
+func (s *shellSession) Resize(rows, cols int) error {
+    return setPtySize(s.File, rows, cols)
+}
+
+// Closing the master hangs up the terminal. In case the command ignores that,
+// its process group is sent SIGHUP too.
+func (s *shellSession) Close() error {
+    var err error
+    s.closeOnce.Do(func() {
+        err = s.File.Close()
+        syscall.Kill(-s.cmd.Process.Pid, syscall.SIGHUP)
+    })
+    return err
+}
+
+// Exit status, or -1 and the signal if killed
+func (s *shellSession) Wait() *ShellExit {
+    s.cmd.Wait()
+    r := NewShellExit(s.cmd.ProcessState.ExitCode())
+    if ws, ok := s.cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+        r.Signal = ws.Signal().String()
+    }
+    return r
+}
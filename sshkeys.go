@@ -0,0 +1,326 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/binary"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/user"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+var sshKeyTypes = []string{
+    "ssh-rsa",
+    "ssh-ed25519",
+    "ecdsa-sha2-nistp256",
+    "ecdsa-sha2-nistp384",
+    "ecdsa-sha2-nistp521",
+    "sk-ssh-ed25519@openssh.com",
+    "sk-ecdsa-sha2-nistp256@openssh.com",
+}
+
+// OpenSSH-style: SHA256 of the key blob, base64 without padding
+func sshFingerprint(blob []byte) string {
+    sum := sha256.Sum256(blob)
+    return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Parse "type base64 [comment]", the format of a .pub file. The blob must
+// begin with the same key type.
+func parseSshPublicKey(line string) (*SshKey, error) {
+    f := strings.Fields(line)
+    if len(f) < 2 {
+        return nil, fmt.Errorf("Not an SSH public key")
+    }
+
+    keyType := f[0]
+    if !containString(sshKeyTypes, keyType) {
+        return nil, fmt.Errorf("Unsupported key type: %v", keyType)
+    }
+
+    blob, err := base64.StdEncoding.DecodeString(f[1])
+    if err != nil {
+        return nil, fmt.Errorf("Key is not valid base64")
+    }
+
+    if len(blob) < 4 {
+        return nil, fmt.Errorf("Key too short")
+    }
+    n := binary.BigEndian.Uint32(blob)
+    if uint64(n) > uint64(len(blob) - 4) || string(blob[4:4+n]) != keyType {
+        return nil, fmt.Errorf("Key content does not match type %v", keyType)
+    }
+
+    k := &SshKey{KeyType: keyType, Fingerprint: sshFingerprint(blob), Comment: strings.Join(f[2:], " ")}
+    k.line = strings.TrimSpace(keyType + " " + base64.StdEncoding.EncodeToString(blob) + " " + k.Comment)
+    return k, nil
+}
+
+// An authorized_keys line may have options before the key. Skip them.
+func parseAuthorizedKey(line string) (*SshKey, error) {
+    line = strings.TrimSpace(line)
+    if line == "" || strings.HasPrefix(line, "#") {
+        return nil, fmt.Errorf("No key")
+    }
+
+    f := strings.Fields(line)
+    for i := range f {
+        if containString(sshKeyTypes, f[i]) {
+            return parseSshPublicKey(strings.Join(f[i:], " "))
+        }
+    }
+    return nil, fmt.Errorf("No key")
+}
+
+type sshUser struct {
+    home string
+    uid, gid int
+}
+
+func lookupSshUser(name string) (*sshUser, error) {
+    u, err := user.Lookup(name)
+    if err != nil {
+        return nil, fmt.Errorf("No such user: %v", name)
+    }
+    uid,_ := strconv.Atoi(u.Uid)
+    gid,_ := strconv.Atoi(u.Gid)
+    return &sshUser{u.HomeDir, uid, gid}, nil
+}
+
+// The user owns ~/.ssh and may have made it, or anything in it, a symlink to
+// somewhere only root should touch. Every path under it is opened relative to
+// a descriptor and never followed.
+func (u *sshUser) openSshDir(create bool) (int, error) {
+    home, err := syscall.Open(u.home, syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_CLOEXEC, 0)
+    if err != nil {
+        return -1, err
+    }
+    defer syscall.Close(home)
+
+    const flags = syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+    dir, err := syscall.Openat(home, ".ssh", flags, 0)
+    if err == syscall.ENOENT && create {
+        if err = syscall.Mkdirat(home, ".ssh", 0700); err == nil {
+            dir, err = syscall.Openat(home, ".ssh", flags, 0)
+        }
+    }
+    if err == syscall.ELOOP || err == syscall.ENOTDIR {
+        return -1, fmt.Errorf("%v/.ssh is not a directory", u.home)
+    }
+    return dir, err
+}
+
+func (u *sshUser) readAuthorizedKeys() ([]string, error) {
+    dir, err := u.openSshDir(false)
+    if err == syscall.ENOENT {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer syscall.Close(dir)
+
+    // Non-blocking, in case it is a FIFO
+    fd, err := syscall.Openat(dir, "authorized_keys", syscall.O_RDONLY | syscall.O_NOFOLLOW | syscall.O_NONBLOCK | syscall.O_CLOEXEC, 0)
+    if err == syscall.ENOENT {
+        return nil, nil
+    }
+    if err == syscall.ELOOP {
+        return nil, fmt.Errorf("authorized_keys is a symlink")
+    }
+    if err != nil {
+        return nil, err
+    }
+    f := os.NewFile(uintptr(fd), "authorized_keys")
+    defer f.Close()
+
+    if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+        return nil, fmt.Errorf("authorized_keys is not a regular file")
+    }
+
+    b, err := ioutil.ReadAll(f)
+    if err != nil {
+        return nil, err
+    }
+    return strings.Split(strings.TrimRight(string(b), "\n"), "\n"), nil
+}
+
+// sshd refuses keys if ~/.ssh or authorized_keys is writable by others, or
+// not owned by the user. Write to a temporary file, then rename, which
+// replaces a symlink rather than following it.
+func (u *sshUser) writeAuthorizedKeys(lines []string) error {
+    dir, err := u.openSshDir(true)
+    if err != nil {
+        return err
+    }
+    defer syscall.Close(dir)
+
+    if err := syscall.Fchmod(dir, 0700); err != nil {
+        return err
+    }
+    if err := syscall.Fchown(dir, u.uid, u.gid); err != nil {
+        return err
+    }
+
+    var buf bytes.Buffer
+    for _,n := range lines {
+        buf.WriteString(n + "\n")
+    }
+
+    const tmp = "authorized_keys.pnpi-tmp"
+    syscall.Unlinkat(dir, tmp)
+    fd, err := syscall.Openat(dir, tmp, syscall.O_WRONLY | syscall.O_CREAT | syscall.O_EXCL | syscall.O_NOFOLLOW | syscall.O_CLOEXEC, 0600)
+    if err != nil {
+        return err
+    }
+    f := os.NewFile(uintptr(fd), tmp)
+
+    _, err = f.Write(buf.Bytes())
+    if err == nil {
+        err = syscall.Fchown(fd, u.uid, u.gid)
+    }
+    if err == nil {
+        err = f.Sync()
+    }
+    if e := f.Close(); err == nil {
+        err = e
+    }
+    if err == nil {
+        err = syscall.Renameat(dir, tmp, dir, "authorized_keys")
+    }
+    if err != nil {
+        syscall.Unlinkat(dir, tmp)
+    }
+    return err
+}
+
+func ListSshKeys(name string) (*SshKeysReport, error) {
+    r := NewSshKeysReport(name)
+
+    u, err := lookupSshUser(name)
+    if err != nil {
+        return r, err
+    }
+
+    lines, err := u.readAuthorizedKeys()
+    for _,n := range lines {
+        if k, e := parseAuthorizedKey(n); e == nil {
+            r.Keys = append(r.Keys, *k)
+        }
+    }
+    return r, err
+}
+
+// All keys are validated before any is added. Keys already present are skipped.
+func AddSshKeys(name string, keys []string) error {
+    u, err := lookupSshUser(name)
+    if err != nil {
+        return err
+    }
+
+    lines, err := u.readAuthorizedKeys()
+    if err != nil {
+        return err
+    }
+
+    present := NewStringSet()
+    for _,n := range lines {
+        if k, e := parseAuthorizedKey(n); e == nil {
+            present.Add(k.Fingerprint)
+        }
+    }
+
+    // A line break would smuggle in a line of its own, options and all.
+    // Only the key as parsed is written.
+    for _,n := range keys {
+        if strings.ContainsAny(n, "\r\n") {
+            return fmt.Errorf("Key must be a single line")
+        }
+        k, err := parseSshPublicKey(n)
+        if err != nil {
+            return err
+        }
+        if !present.Contain(k.Fingerprint) {
+            present.Add(k.Fingerprint)
+            lines = append(lines, k.line)
+        }
+    }
+    return u.writeAuthorizedKeys(lines)
+}
+
+// Other lines, including comments and unrecognised keys, are kept as they are.
+func RemoveSshKey(name string, fingerprint string) error {
+    u, err := lookupSshUser(name)
+    if err != nil {
+        return err
+    }
+
+    lines, err := u.readAuthorizedKeys()
+    if err != nil {
+        return err
+    }
+
+    var kept []string
+    for _,n := range lines {
+        if k, e := parseAuthorizedKey(n); e == nil && k.Fingerprint == fingerprint {
+            continue
+        }
+        kept = append(kept, n)
+    }
+
+    if len(kept) == len(lines) {
+        return fmt.Errorf("No key with fingerprint %v", fingerprint)
+    }
+    return u.writeAuthorizedKeys(kept)
+}
+
+// Host keys, so the user can verify SSH's first-connection prompt
+func SshHostKeys() []SshKey {
+    paths,_ := filepath.Glob("/etc/ssh/ssh_host_*_key.pub")
+    sort.Strings(paths)
+
+    var keys []SshKey
+    for _,n := range paths {
+        b, err := ioutil.ReadFile(n)
+        if err != nil {
+            continue
+        }
+        if k, err := parseSshPublicKey(string(b)); err == nil {
+            k.Comment = ""
+            keys = append(keys, *k)
+        }
+    }
+    return keys
+}
+
+func sshKeysReport(name string) *SshKeysReport {
+    r, err := ListSshKeys(name)
+    if err != nil {
+        LogDebug("Cannot list SSH keys:", err)
+    }
+    return r
+}
+
+func SshPasswordAuthentication() (bool, error) {
+    out, err := raspi_config("get_ssh_password_auth")
+    if err != nil {
+        return true, err
+    }
+    return (strings.TrimSpace(out) == "0"), err
+}
+
+func SetSshPasswordAuthentication(on bool) error {
+    code := "1"
+    if on {
+        code = "0"
+    }
+    _, err := raspi_config("do_ssh_password_auth", code)
+    return err
+}
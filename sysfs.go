@@ -0,0 +1,29 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// System files under /proc, /sys and /etc are read relative to this root, so
+// they can be replaced by fixture files.
+var sysRoot = "/"
+
+func SetSysRoot(d string) {
+    sysRoot = d
+}
+
+func sysPath(path string) string {
+    return filepath.Join(sysRoot, path)
+}
+
+func openSysFile(path string) (*os.File, error) {
+    return os.Open(sysPath(path))
+}
+
+func readSysFile(path string) (string, error) {
+    b, err := ioutil.ReadFile(sysPath(path))
+    return strings.TrimSpace(string(b)), err
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const tunnelDialTimeout = 5 * time.Second
+
+// A channel to a local TCP port or a shell
+type tunnel struct {
+    channel uint16
+    conn io.ReadWriteCloser   // nil until connected
+
+    // Credit for sending to the client
+    window int
+    windowChanged *sync.Cond
+
+    // Data from the client, not yet written to the connection
+    inbox [][]byte
+    inboxBytes int
+    inboxSignal chan struct{}
+
+    closeSent, closeReceived, reset bool
+    drained chan struct{}     // closed once drain stops writing
+    done chan struct{}
+}
+
+type tunnels struct {
+    sync.Mutex
+    m map[uint16]*tunnel
+    out chan<- *Frame
+    done chan struct{}
+}
+
+// Returns false if Interact is gone
+func (ts *tunnels) send(f *Frame) bool {
+    select {
+    case ts.out <- f:
+        return true
+    case <-ts.done:
+        return false
+    }
+}
+
+// Lock must be held
+func (ts *tunnels) remove(t *tunnel) {
+    if ts.m[t.channel] == t {
+        delete(ts.m, t.channel)
+    }
+    t.windowChanged.Broadcast()
+}
+
+// Lock must be held
+func (ts *tunnels) abort(t *tunnel) {
+    t.reset = true
+    if t.conn != nil {
+        t.conn.Close()
+    }
+    ts.remove(t)
+    t.signal()
+}
+
+// Wake drain. Lock must be held.
+func (t *tunnel) signal() {
+    select {
+    case t.inboxSignal <- struct{}{}:
+    default:
+    }
+}
+
+// Shut the write side, so the service sees EOF but can still answer. A shell
+// has no such thing, so it is hung up.
+func halfClose(conn io.ReadWriteCloser) {
+    if c, ok := conn.(*net.TCPConn); ok {
+        c.CloseWrite()
+        return
+    }
+    conn.Close()
+}
+
+// Block until there is credit. Returns at most n, 0 if aborted.
+func (ts *tunnels) takeWindow(t *tunnel, n int) int {
+    ts.Lock()
+    defer ts.Unlock()
+
+    for t.window == 0 && !t.reset {
+        t.windowChanged.Wait()
+    }
+    if t.reset {
+        return 0
+    }
+    if n > t.window {
+        n = t.window
+    }
+    t.window -= n
+    return n
+}
+
+// Connect, then relay data to the client as credit allows, until the
+// connection ends. Sending also waits for the USB writer, which takes control
+// objects first.
+func (ts *tunnels) run(t *tunnel, connect func() (io.ReadWriteCloser, error)) {
+    defer close(t.done)
+
+    conn, err := connect()
+
+    // A shell is reaped however this ends. Normally its exit status is sent
+    // first.
+    shell, _ := conn.(*shellSession)
+    reaped := false
+    defer func() {
+        if shell != nil && !reaped {
+            shell.Close()
+            shell.Wait()
+        }
+    }()
+
+    // A CLOSE while connecting only ends what the client sends, which drain
+    // still writes.
+    ts.Lock()
+    if err != nil || t.reset {
+        if conn != nil {
+            conn.Close()
+        }
+        ts.remove(t)
+        ts.Unlock()
+
+        if err != nil {
+            ts.send(NewResetFrame(t.channel, err))
+        }
+        return
+    }
+    t.conn = conn
+    ts.Unlock()
+
+    if !ts.send(&Frame{t.channel, FrameOpen, nil}) {
+        conn.Close()
+        return
+    }
+
+    go ts.drain(t)
+
+    var rerr error
+    buf := make([]byte, maxFramePayload)
+    for {
+        n := ts.takeWindow(t, len(buf))
+        if n == 0 {
+            break
+        }
+
+        m, err := conn.Read(buf[:n])
+
+        // Give back credit not used
+        ts.Lock()
+        t.window += n - m
+        ts.Unlock()
+
+        if m > 0 {
+            if !ts.send(&Frame{t.channel, 0, append([]byte(nil), buf[:m]...)}) {
+                break
+            }
+        }
+        if err != nil {
+            rerr = err
+            break
+        }
+    }
+
+    // A TCP service that has finished sending may still take data, until the
+    // client closes too. Otherwise the connection is done both ways.
+    _, isTcp := conn.(*net.TCPConn)
+    halfOpen := isTcp && rerr == io.EOF
+    if !halfOpen {
+        conn.Close()
+    }
+
+    // Exit status goes before CLOSE
+    if shell != nil {
+        r := shell.Wait()
+        reaped = true
+        r.Channel = t.channel
+        ts.Lock()
+        aborted := t.reset
+        ts.Unlock()
+        if !aborted {
+            ts.send(NewControlFrame(r))
+        }
+    }
+
+    ts.Lock()
+    reply := !t.reset && !t.closeSent
+    t.closeSent = true
+    if t.closeReceived {
+        ts.remove(t)
+    }
+    ts.Unlock()
+
+    if reply {
+        ts.send(&Frame{t.channel, FrameClose, nil})
+    }
+
+    if halfOpen {
+        <-t.drained
+        conn.Close()
+    }
+}
+
+// Write client data to the connection, granting the client credit for as much
+// as is written. Once the client has closed, and everything it sent is
+// written, the connection is half-closed.
+func (ts *tunnels) drain(t *tunnel) {
+    defer close(t.drained)
+
+    for {
+        select {
+        case <-t.inboxSignal:
+        case <-t.done:
+            return
+        }
+
+        ts.Lock()
+        inbox := t.inbox
+        t.inbox = nil
+        closing, reset := t.closeReceived, t.reset
+        ts.Unlock()
+
+        if reset {
+            return
+        }
+
+        for _,data := range inbox {
+            if _, err := t.conn.Write(data); err != nil {
+                t.conn.Close()
+                return
+            }
+
+            ts.Lock()
+            t.inboxBytes -= len(data)
+            ts.Unlock()
+
+            // No use for credit once the client has closed
+            if !closing && !ts.send(NewWindowFrame(t.channel, len(data))) {
+                return
+            }
+        }
+
+        // Data never follows CLOSE, so all of it was in this inbox.
+        if closing {
+            halfClose(t.conn)
+            return
+        }
+    }
+}
+
+// Target is "tcp:<port>", or "shell" optionally followed by ":<rows>x<cols>"
+func (ts *tunnels) open(channel uint16, target string) error {
+    var connect func() (io.ReadWriteCloser, error)
+
+    kind, arg := target, ""
+    if i := strings.Index(target, ":"); i >= 0 {
+        kind, arg = target[:i], target[i+1:]
+    }
+
+    switch kind {
+    case "tcp":
+        port, err := strconv.Atoi(arg)
+        if err != nil {
+            return fmt.Errorf("Invalid port: %v", target)
+        }
+        if !policy.tunnelPortAllowed(port) {
+            return fmt.Errorf("Port not allowed: %v", port)
+        }
+        connect = func() (io.ReadWriteCloser, error) {
+            return net.DialTimeout("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)), tunnelDialTimeout)
+        }
+
+    case "shell":
+        rows, cols, err := parsePtySize(arg)
+        if err != nil {
+            return err
+        }
+        if err := checkShellPolicy(); err != nil {
+            return err
+        }
+        // Not a nil *shellSession in the interface on error
+        connect = func() (io.ReadWriteCloser, error) {
+            s, err := StartShell(rows, cols)
+            if err != nil {
+                return nil, err
+            }
+            return s, nil
+        }
+
+    default:
+        return fmt.Errorf("Unsupported target: %v", target)
+    }
+
+    ts.Lock()
+    defer ts.Unlock()
+
+    if channel == ControlChannel {
+        return fmt.Errorf("Cannot open control channel")
+    }
+    if _, ok := ts.m[channel]; ok {
+        return fmt.Errorf("Channel already open: %v", channel)
+    }
+
+    t := &tunnel{
+        channel: channel,
+        window: initialWindow,
+        windowChanged: sync.NewCond(&ts.Mutex),
+        inboxSignal: make(chan struct{}, 1),
+        drained: make(chan struct{}),
+        done: make(chan struct{}),
+    }
+    ts.m[channel] = t
+
+    go ts.run(t, connect)
+    return nil
+}
+
+func (ts *tunnels) resize(cmd *Command) error {
+    if len(cmd.Args) != 3 {
+        return fmt.Errorf("Expected channel, rows and cols")
+    }
+    channel, err := strconv.ParseUint(cmd.Args[0], 10, 16)
+    if err != nil {
+        return fmt.Errorf("Invalid channel: %v", cmd.Args[0])
+    }
+    rows, cols, err := parsePtySize(cmd.Args[1] + "x" + cmd.Args[2])
+    if err != nil {
+        return err
+    }
+
+    ts.Lock()
+    defer ts.Unlock()
+
+    t, ok := ts.m[uint16(channel)]
+    if !ok || t.conn == nil {
+        return fmt.Errorf("Channel not open: %v", channel)
+    }
+    s, ok := t.conn.(*shellSession)
+    if !ok {
+        return fmt.Errorf("Not a shell: %v", channel)
+    }
+    return s.Resize(rows, cols)
+}
+
+// Frames for unknown channels are ignored. They may be crossing a CLOSE or
+// RESET from this end.
+func (ts *tunnels) handle(f *Frame) {
+    if f.Flags & FrameOpen != 0 {
+        if err := ts.open(f.Channel, string(f.Payload)); err != nil {
+            LogDebug("Cannot open channel:", err)
+            go ts.send(NewResetFrame(f.Channel, err))
+        }
+        return
+    }
+
+    ts.Lock()
+    defer ts.Unlock()
+
+    t, ok := ts.m[f.Channel]
+    if !ok {
+        LogDebugf("Frame for unknown channel: %v", f)
+        return
+    }
+
+    switch {
+    case f.Flags & FrameReset != 0:
+        ts.abort(t)
+
+    // Data already received is still written, then drain half-closes.
+    case f.Flags & FrameClose != 0:
+        t.closeReceived = true
+        t.signal()
+        if t.closeSent {
+            ts.remove(t)
+        }
+
+    case f.Flags & FrameWindow != 0:
+        if len(f.Payload) == 4 {
+            t.window += int(binary.BigEndian.Uint32(f.Payload))
+            t.windowChanged.Broadcast()
+        }
+
+    default:
+        // Client must not send beyond the credit it has been given.
+        if t.closeReceived || t.inboxBytes + len(f.Payload) > initialWindow {
+            ts.abort(t)
+            go ts.send(NewResetFrame(f.Channel, fmt.Errorf("Flow control violated")))
+            return
+        }
+        t.inbox = append(t.inbox, f.Payload)
+        t.inboxBytes += len(f.Payload)
+        t.signal()
+    }
+}
+
+// Forward channels to local TCP ports or shells, for SSH, VNC or a console
+// without a network. Takes frames and channel commands. This never blocks on
+// USB, so Interact can always pass them on.
+func ForwardTunnels(in <-chan interface{}, out chan<- *Frame, notify chan<- int, id int) {
+    defer RecoverDo(
+        func(x interface{}) {
+            notify <- id
+            LogDebug("Tunnels terminate due to:", x)
+        },
+        func() {
+            LogDebug("Tunnels terminate normally")
+        },
+    )
+
+    ts := &tunnels{m: make(map[uint16]*tunnel), out: out, done: make(chan struct{})}
+    defer close(ts.done)
+    defer func() {
+        ts.Lock()
+        defer ts.Unlock()
+        for _,t := range ts.m {
+            ts.abort(t)
+        }
+    }()
+
+    for x := range in {
+        switch x := x.(type) {
+        case *Frame:
+            ts.handle(x)
+        case *Command:
+            var err error
+            switch x.Action {
+            case "shell_resize": err = ts.resize(x)
+            default: panic(fmt.Sprintf("Invalid command: %v", x))
+            }
+            if err != nil {
+                LogDebug("Channel command error:", err)
+            }
+        }
+    }
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "time"
+)
+
+// Access point keeps push-button mode open for 2 minutes
+const wpsWalkTime = 120 * time.Second
+
+// Signalled by the client's cancel command, which Interact handles itself, as
+// the executor is busy with the operation to be cancelled.
+var wifiCancel = make(chan struct{}, 1)
+
+func CancelWifi() {
+    select {
+    case wifiCancel <- struct{}{}:
+    default:
+    }
+}
+
+// Forget a cancel that came when nothing was in progress
+func resetWifiCancel() {
+    select {
+    case <-wifiCancel:
+    default:
+    }
+}
+
+// Wait a second. Returns false if cancelled.
+func waitUnlessCancelled() bool {
+    select {
+    case <-time.After(1 * time.Second):
+        return true
+    case <-wifiCancel:
+        return false
+    }
+}
+
+func WifiWps(bssid string, report func(interface{})) error {
+    resetWifiCancel()
+    if _, err := raspi_config("do_wifi_wps", bssid); err != nil {
+        return err
+    }
+    report(NewProgress("wps", StageStarted))
+
+    // wps_pbc drops the current connection first. Until we see that happen,
+    // a "completed" state still refers to the old network.
+    left := false
+    last := StageStarted
+
+    err := fmt.Errorf("WPS timed out")
+    for deadline := time.Now().Add(wpsWalkTime); time.Now().Before(deadline); {
+        if !waitUnlessCancelled() {
+            err = fmt.Errorf("WPS cancelled")
+            break
+        }
+
+        status, err := WifiStatus()
+        if err != nil {
+            LogDebug("Cannot obtain WiFi status:", err)
+            continue
+        }
+
+        stage := stageOf(strings.ToUpper(status["wpa_state"]))
+        if stage != StageCompleted {
+            left = true
+        } else if !left {
+            continue
+        }
+
+        if stage != last {
+            last = stage
+            p := NewProgress("wps", stage)
+            if stage == StageCompleted {
+                p.SSID, p.Done = status["ssid"], true
+            }
+            report(p)
+        }
+
+        if stage == StageCompleted {
+            return SaveWifiConfig()
+        }
+    }
+
+    raspi_config("cancel_wifi_wps")
+
+    report(NewProgressFailure("wps", err))
+    return err
+}